@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"os"
+	"os/signal"
+
+	"github.com/spf13/viper"
+	"github.com/team836/clowd-storage/internal/storagenode"
+	"github.com/team836/clowd-storage/pkg/logger"
+)
+
+/**
+Reference storage node which serves the shards on the local filesystem.
+
+The node connects to the server as the clowder who owns it,
+and keeps connected until it is interrupted.
+See `node.example.yml` for the configs.
+*/
+func main() {
+	configPath := flag.String("config", "./node.yml", "path of the node config file")
+	flag.Parse()
+
+	// load config file
+	viper.SetConfigFile(*configPath)
+	if err := viper.ReadInConfig(); err != nil {
+		logger.Console().Fatalf("Error reading config file, %s", err)
+	}
+
+	// set default values of the optional configs
+	viper.SetDefault("NODE.STORAGE_DIR", "./shards")
+	viper.SetDefault("NODE.MAX_STORAGE", 0)
+	viper.SetDefault("NODE.BANDWIDTH", 100)
+	viper.SetDefault("NODE.RECONNECT_WAIT", "5s")
+
+	store, err := storagenode.OpenStore(viper.GetString("NODE.STORAGE_DIR"), viper.GetUint64("NODE.MAX_STORAGE"))
+	if err != nil {
+		logger.Console().Fatalf("Error opening the shard store, %s", err)
+	}
+
+	client := storagenode.NewClient(&storagenode.Config{
+		ServerURL:     viper.GetString("NODE.SERVER_URL"),
+		Token:         viper.GetString("NODE.TOKEN"),
+		MachineID:     viper.GetString("NODE.MACHINE_ID"),
+		Zone:          viper.GetString("NODE.ZONE"),
+		Bandwidth:     viper.GetUint("NODE.BANDWIDTH"),
+		ReconnectWait: viper.GetDuration("NODE.RECONNECT_WAIT"),
+	}, store)
+
+	// stop the node gracefully by interrupt signal
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, os.Interrupt)
+		<-quit
+		cancel()
+	}()
+
+	if err := client.Run(ctx); err != nil {
+		logger.Console().Fatalf("Error running the node, %s", err)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path"
+
+	"github.com/spf13/viper"
+	"github.com/team836/clowd-storage/internal/module/keyrotation"
+	"github.com/team836/clowd-storage/internal/provider"
+	"github.com/team836/clowd-storage/pkg/database"
+	"github.com/team836/clowd-storage/pkg/logger"
+)
+
+/**
+Admin command for rotating the master key.
+
+Before running this command, add new master key to `ENCRYPTION.MASTER_KEYS`,
+change `ENCRYPTION.ACTIVE_KEY_ID` to its id, and restart every server with the new env file.
+The servers running with the old env file cannot decrypt the re-wrapped files,
+so this command refuses to run until every running server reports the active master key.
+After the rotation is finished, the old master keys can be removed from the env file.
+*/
+func main() {
+	batchSize := flag.Int("batch", 500, "count of files to re-wrap in one transaction")
+	flag.Parse()
+
+	currDir, err := os.Getwd()
+	if err != nil {
+		logger.Console().Fatal(err)
+	}
+
+	// set app root path as config
+	viper.Set("AppRoot", path.Join(currDir, "../../"))
+
+	// load env file
+	viper.SetConfigFile(path.Join(viper.GetString("AppRoot"), "./env.yml"))
+	if err := viper.ReadInConfig(); err != nil {
+		logger.Console().Fatalf("Error reading env file, %s", err)
+	}
+
+	// set default values of the optional configs
+	provider.ConfigService()
+
+	// open database connection
+	conn := database.Conn()
+	defer conn.Close()
+
+	// the servers must be able to unwrap the data keys with the active master key
+	if err := keyrotation.CheckDeployment(); err != nil {
+		logger.Console().Fatalf("Error rotating the master key, %s", err)
+	}
+
+	progress, err := keyrotation.Rotate(*batchSize, func(progress *keyrotation.Progress) {
+		logger.Console().Infof(
+			"Re-wrapped %d / %d files (%d failed)",
+			progress.Done,
+			progress.Total,
+			progress.Failed,
+		)
+	})
+
+	if err != nil {
+		logger.Console().Fatalf("Error rotating the master key, run again to resume, %s", err)
+	}
+
+	if progress.Failed != 0 {
+		logger.Console().Warnf("%d files are not re-wrapped, keep the old master keys", progress.Failed)
+		return
+	}
+
+	logger.Console().Infof("Rotation is finished, the old master keys can be removed")
+}
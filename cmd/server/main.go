@@ -31,20 +31,39 @@ func main() {
 		logger.Console().Fatalf("Error reading env file, %s", err)
 	}
 
+	// set default values of the optional configs
+	provider.ConfigService()
+
+	// load the master key for encrypting files
+	provider.EncryptionService()
+
 	// open database connection
 	conn := provider.DBService()
 	defer conn.Close()
 
+	// report the loaded master keys for the key rotation in background
+	provider.KeyReportService()
+
+	// start advancing the states of the disconnected nodes in background
+	provider.LifecycleService()
+
+	// start repairing the shards on the lost nodes in background
+	provider.RepairService()
+
+	// start auditing the shards on the nodes in background
+	provider.AuditService()
+
 	// build all of the router
 	router := provider.RouteService()
 
 	// start server
 	go func() {
 		err := router.StartServer(&http.Server{
-			Addr:           ":" + viper.GetString("APP.PORT"),
-			ReadTimeout:    5 * time.Second,
-			WriteTimeout:   7 * time.Second,
-			MaxHeaderBytes: 1 << 20,
+			Addr:              ":" + viper.GetString("APP.PORT"),
+			ReadHeaderTimeout: viper.GetDuration("APP.READ_HEADER_TIMEOUT"),
+			ReadTimeout:       viper.GetDuration("APP.READ_TIMEOUT"),  // long enough for streaming large files
+			WriteTimeout:      viper.GetDuration("APP.WRITE_TIMEOUT"), // long enough for downloading large files
+			MaxHeaderBytes:    1 << 20,
 		})
 
 		if err != nil {
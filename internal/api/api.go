@@ -3,6 +3,7 @@ package api
 import (
 	"github.com/labstack/echo/v4"
 	"github.com/team836/clowd-storage/internal/api/client"
+	"github.com/team836/clowd-storage/internal/api/clowder"
 	"github.com/team836/clowd-storage/internal/api/node"
 	"github.com/team836/clowd-storage/internal/middleware"
 	"github.com/team836/clowd-storage/internal/middleware/auth"
@@ -14,4 +15,7 @@ func RegisterHandlers(group *echo.Group) {
 
 	clientGroup := group.Group("/client", auth.AuthenticateClowdee)
 	client.RegisterHandlers(clientGroup)
+
+	clowderGroup := group.Group("/clowder", auth.AuthenticateClowder)
+	clowder.RegisterHandlers(clowderGroup)
 }
@@ -1,14 +1,16 @@
 package client
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"net/http"
-	"sync"
 	"time"
 
 	"github.com/labstack/echo/v4/middleware"
 
 	"github.com/team836/clowd-storage/internal/module/operationq"
+	"github.com/team836/clowd-storage/internal/module/repair"
 	"github.com/team836/clowd-storage/internal/module/spool"
 
 	"github.com/team836/clowd-storage/pkg/database"
@@ -26,10 +28,17 @@ const (
 	uploadLimit = "100M"
 )
 
+var (
+	errNoAvailableNodes = errors.New("available nodes are not exist")
+	errInvalidFile      = errors.New("cannot handle the file")
+	errNotAcknowledged  = errors.New("the nodes don't acknowledge the saved shards")
+)
+
 type fileOnClient struct {
-	Name  string `json:"name"`
-	Order int    `json:"order"`
-	Data  string `json:"data"` // base64 encoded
+	Name    string `json:"name"`
+	Order   int    `json:"order"`
+	Data    string `json:"data"`              // base64 encoded
+	Profile string `json:"profile,omitempty"` // erasure profile, the default profile if empty
 }
 
 type fileView struct {
@@ -49,7 +58,9 @@ type fileToDelete struct {
 func RegisterHandlers(group *echo.Group) {
 	group.GET("/dir", fileListController)
 	group.POST("/files", uploadController, middleware.BodyLimit(uploadLimit))
+	group.POST("/files/stream", streamUploadController)
 	group.GET("/files", downloadController)
+	group.GET("/files/:name", rangeDownloadController)
 	group.DELETE("/files", deleteController)
 }
 
@@ -77,24 +88,31 @@ func uploadController(ctx echo.Context) error {
 	// create upload queue
 	uq := operationq.NewUQ()
 
-	// encode every file data using reed solomon algorithm
+	// encrypt and encode every file data using reed solomon algorithm
 	// and push to upload queue
 	for _, file := range files {
-		// encode the file data
-		shards, size, err := errcorr.Encode(file.Data)
+		// find the erasure profile which the clowdee chooses
+		profile, err := errcorr.FindProfile(file.Profile)
+		if err != nil {
+			logger.File().Infof("Error finding the erasure profile, %s", err)
+			return ctx.String(http.StatusNotAcceptable, "Cannot use the erasure profile: "+file.Profile)
+		}
+
+		// convert base64 data to byte array
+		data, err := base64.StdEncoding.DecodeString(file.Data)
 		if err != nil {
-			logger.File().Infof("Error encoding the file, %s", err)
+			logger.File().Infof("Error decoding the file, %s", err)
 			return ctx.String(http.StatusNotAcceptable, "Cannot handle this file: "+file.Name)
 		}
 
-		encFile := &model.EncFile{
-			Model: &model.File{
-				GoogleID: clowdee.GoogleID,
-				Name:     file.Name,
-				Position: int16(file.Order),
-				Size:     size,
-			},
-			Data: shards,
+		// encrypt and encode the file data
+		encFile, err := encodeFile(clowdee, file.Name, file.Order, profile, data)
+		if err != nil {
+			if err == errInvalidFile {
+				return ctx.String(http.StatusNotAcceptable, "Cannot handle this file: "+file.Name)
+			}
+
+			return ctx.NoContent(http.StatusInternalServerError)
 		}
 
 		// if the file is already exists
@@ -107,52 +125,140 @@ func uploadController(ctx echo.Context) error {
 		uq.Push(encFile)
 	}
 
-	// this area almost change all nodes' status
-	// so, protect it using mutex for all node's status
-	spool.Pool().NodesStatusLock.Lock()
-	defer func() {
-		// when panic is occurred, unlock the nodes status lock
-		if r := recover(); r != nil {
-			spool.Pool().NodesStatusLock.Unlock()
-		}
-	}()
+	// save the files to the nodes
+	if err := saveFiles(uq); err != nil {
+		return respondUploadError(ctx, err)
+	}
+
+	return ctx.NoContent(http.StatusCreated)
+}
 
-	// check all nodes' status by ping&pong
-	spool.Pool().CheckAllNodes()
+/**
+Save the files in the upload queue to the nodes.
+*/
+func saveFiles(uq *operationq.UploadQueue) error {
+	quotas, err := scheduleFiles(uq)
+	if err != nil {
+		return err
+	}
+
+	// save each quota and wait for the acknowledgements
+	unacked := operationq.SaveQuotas(quotas)
+	if len(unacked) == 0 {
+		return nil
+	}
+
+	// place the unacknowledged shards on the other nodes once more
+	shards, err := operationq.ShardsToReplace(unacked)
+	if err == nil {
+		err = repair.Restore(shards)
+	}
+
+	if err != nil {
+		logger.File().Errorf("Error saving the shards which are not acknowledged, %s", err)
+		rollbackFiles(uq)
+		return errNotAcknowledged
+	}
+
+	return nil
+}
 
+/**
+Schedule saving for every shards of the files to the nodes.
+The spaces of the nodes are reserved for the shards,
+so the concurrent uploads do not take the same space.
+*/
+func scheduleFiles(uq *operationq.UploadQueue) (map[*spool.ActiveNode][]*model.ShardToSave, error) {
 	// node selection
 	safeRing, unsafeRing := spool.Pool().SelectNodes()
 	if safeRing.Len()+unsafeRing.Len() == 0 {
-		spool.Pool().NodesStatusLock.Unlock()
 		logger.File().Errorf("Available nodes are not exist.")
-		return ctx.String(http.StatusNotAcceptable, "Cannot save the files because currently there are no available nodes")
+		return nil, errNoAvailableNodes
 	}
 
 	// schedule saving for every shards to the nodes
 	// and get results
 	quotas, err := uq.Schedule(safeRing, unsafeRing)
 	if err != nil {
-		spool.Pool().NodesStatusLock.Unlock()
 		logger.File().Errorf("Error scheduling upload, %s", err)
+		return nil, err
+	}
 
-		if err == operationq.ErrLackOfStorage {
-			return ctx.String(http.StatusNotAcceptable, err.Error())
-		}
+	return quotas, nil
+}
 
+/**
+Delete the files in the upload queue which cannot be saved.
+*/
+func rollbackFiles(uq *operationq.UploadQueue) {
+	files := make([]*model.File, 0, len(uq.Files))
+	for _, file := range uq.Files {
+		files = append(files, file.Model)
+	}
+
+	delQ := operationq.NewDelQ()
+	if err := delQ.PushFiles(files...); err != nil {
+		logger.File().Errorf("Error deleting the files which cannot be saved, %s", err)
+		return
+	}
+
+	dispatchDeletion(delQ)
+}
+
+/**
+Respond the error which is occurred while saving the files.
+*/
+func respondUploadError(ctx echo.Context, err error) error {
+	switch err {
+	case errNoAvailableNodes:
+		return ctx.String(http.StatusNotAcceptable, "Cannot save the files because currently there are no available nodes")
+	case operationq.ErrLackOfStorage, operationq.ErrLackOfFailureDomains:
+		return ctx.String(http.StatusNotAcceptable, err.Error())
+	case errNotAcknowledged:
+		return ctx.String(http.StatusServiceUnavailable, "Cannot save the files because the nodes don't respond, try again later")
+	default:
 		return ctx.NoContent(http.StatusInternalServerError)
 	}
+}
+
+/**
+Encrypt the file data of the clowdee with new data key
+and encode it using reed solomon algorithm.
+*/
+func encodeFile(
+	clowdee *model.Clowdee,
+	name string,
+	order int,
+	profile *errcorr.Profile,
+	data []byte,
+) (*model.EncFile, error) {
+	fileModel := &model.File{
+		GoogleID: clowdee.GoogleID,
+		Name:     name,
+		Position: int16(order),
+		Size:     uint(len(data)),
+	}
+	fileModel.SetErasureProfile(profile)
 
-	// save each quota using goroutine
-	for nodeToSave, shards := range quotas {
-		go func(a *spool.ActiveNode, s []*model.ShardToSave) {
-			a.Save <- s
-		}(nodeToSave, shards)
+	// encrypt the file data
+	sealed, dataKey, err := sealSegment(fileModel, data)
+	if err != nil {
+		logger.File().Errorf("Error encrypting the file, %s", err)
+		return nil, err
 	}
 
-	// end of mutex area for nodes status lock
-	spool.Pool().NodesStatusLock.Unlock()
+	// encode the encrypted data
+	shards, err := profile.EncodeBytes(sealed)
+	if err != nil {
+		logger.File().Infof("Error encoding the file, %s", err)
+		return nil, errInvalidFile
+	}
 
-	return ctx.NoContent(http.StatusCreated)
+	return &model.EncFile{
+		Model:   fileModel,
+		Data:    shards,
+		DataKey: dataKey,
+	}, nil
 }
 
 /**
@@ -206,120 +312,112 @@ func downloadController(ctx echo.Context) error {
 		}
 	}
 
-	// schedule every shards for download to the each active nodes
-	// and get quotas for each nodes
-	quotas := dq.Schedule()
-
-	// concurrently download each quota using goroutine
-	var downloadWG sync.WaitGroup
-	for machineID, shards := range quotas {
-		// if the machine is active
-		if activeNode := spool.Pool().FindActiveNode(machineID); activeNode != nil {
-			downloadWG.Add(1)
-
-			// start new worker for download
-			go func(a *spool.ActiveNode, s []*model.ShardToLoad, wg *sync.WaitGroup) {
-				a.Load <- &spool.LoadChan{Shards: s, WG: wg}
-			}(activeNode, shards, &downloadWG)
-		}
-	}
-
-	// wait for all download workers are done
-	downloadWG.Wait()
+	// download enough shards from the active nodes
+	dq.Load(ctx.Request().Context())
 
 	response := make([]*fileOnClient, 0)
 	reconstructedShards := make([]*model.ShardToLoad, 0)
+	verifiedShards := make([]*model.ShardToLoad, 0)
 
 	// make response data
 	for _, file := range dq.Files {
-		var shards [][]byte
-		var missedShards []*model.ShardToLoad
-
-		// merge all shard data
-		// if the shard is invalid, make to nil for reconstruction
-		for _, loadedShard := range file.Shards {
-			// if shard is missing or corrupted, make to nil data
-			if len(loadedShard.Data) == 0 ||
-				errcorr.IsCorruptedChecksum(loadedShard.Data, loadedShard.Model.Checksum) {
-				loadedShard.Data = nil
-			}
-
-			// if shard data is missed, add to missed list
-			if loadedShard.Data == nil {
-				missedShards = append(missedShards, loadedShard)
-			}
-
-			shards = append(shards, loadedShard.Data)
-		}
-
 		// reconstruct the original file from the shards
-		fileData, reconstructedShardData, err := errcorr.Decode(shards, int(file.Model.Size))
+		fileData, missedShards, err := decodeSegment(file)
 		if err != nil {
 			logger.File().Infof("Error decoding the shards, %s", err)
 			return ctx.String(http.StatusInternalServerError, "file download error")
 		}
 
-		// insert reconstructed data to the missed list
-		for idx, missedShard := range missedShards {
-			missedShard.Data = reconstructedShardData[idx]
-		}
-
 		// merge to all missed list
 		reconstructedShards = append(reconstructedShards, missedShards...)
 
+		// the loaded shards match the checksums recorded at the upload, and the segment is decrypted from them
+		for _, shard := range file.Shards {
+			if shard.Data != nil && !shard.Failed {
+				verifiedShards = append(verifiedShards, shard)
+			}
+		}
+
 		response = append(
 			response,
 			&fileOnClient{
 				Name:  file.Model.Name,
 				Order: int(file.Model.Position),
-				Data:  fileData,
+				Data:  base64.StdEncoding.EncodeToString(fileData),
 			},
 		)
 	}
 
-	go restoreShards(reconstructedShards)
+	go repair.Restore(reconstructedShards)
+	go prepareChallenges(verifiedShards)
 
 	return ctx.JSON(http.StatusOK, &response)
 }
 
 /**
-Restore(re-upload) the reconstruct shards to the another nodes.
+Create the audit challenges of the downloaded shards which have no unused challenge.
 */
-func restoreShards(reconstructedShards []*model.ShardToLoad) {
-	// there are not exists shards to restore
-	if len(reconstructedShards) == 0 {
-		return
+func prepareChallenges(shards []*model.ShardToLoad) {
+	if err := operationq.PrepareChallenges(database.Conn(), shards); err != nil {
+		logger.File().Errorf("Error preparing the audit challenges of the downloaded shards, %s", err)
 	}
+}
 
-	rq := operationq.NewRQ()
-	rq.Push(reconstructedShards...)
+/**
+Decode the loaded shards to the original segment data.
+Return the missed shards which are reconstructed for restoring.
+*/
+func decodeSegment(file *model.FileToLoad) ([]byte, []*model.ShardToLoad, error) {
+	storedData, reconstructedShards, err := decodeStoredSegment(file)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	spool.Pool().NodesStatusLock.Lock()
-	defer spool.Pool().NodesStatusLock.Unlock()
+	// decrypt the stored data to the original file
+	fileData, err := openSegment(file.Model, storedData)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	spool.Pool().CheckAllNodes()
+	return fileData, reconstructedShards, nil
+}
 
-	// node selection
-	safeRing, unsafeRing := spool.Pool().SelectNodes()
-	if safeRing.Len()+unsafeRing.Len() == 0 {
-		logger.File().Errorf("Available nodes are not exist.")
-		return
+/**
+Decode the loaded shards to the stored segment data which can be encrypted.
+Return the missed shards which are reconstructed for restoring.
+*/
+func decodeStoredSegment(file *model.FileToLoad) ([]byte, []*model.ShardToLoad, error) {
+	profile := file.Model.ErasureProfile()
+	shards := make([][]byte, profile.TotalShards())
+	var missedShards []*model.ShardToLoad
+
+	// merge all shard data by its position
+	// the invalid or not loaded shard is nil for reconstruction
+	for _, loadedShard := range file.Shards {
+		// if shard data is missed, add to missed list
+		if loadedShard.Failed {
+			missedShards = append(missedShards, loadedShard)
+		}
+
+		shards[loadedShard.Model.Position] = loadedShard.Data
 	}
 
-	// schedule restoring for every shards to the nodes
-	// and get results
-	quotas, err := rq.Schedule(safeRing, unsafeRing)
+	// reconstruct the stored data from the shards
+	storedData, err := profile.Decode(shards, file.Model.StoredSize())
 	if err != nil {
-		logger.File().Errorf("Error scheduling restoring, %s", err)
-		return
+		return nil, nil, err
 	}
 
-	// save each quota using goroutine
-	for nodeToSave, restoreShards := range quotas {
-		go func(a *spool.ActiveNode, s []*model.ShardToSave) {
-			a.Save <- s
-		}(nodeToSave, restoreShards)
+	// insert reconstructed data to the missed list
+	// the missed parity shards are not reconstructed when all data shards are intact
+	reconstructedShards := make([]*model.ShardToLoad, 0, len(missedShards))
+	for _, missedShard := range missedShards {
+		if missedShard.Data = shards[missedShard.Model.Position]; missedShard.Data != nil {
+			reconstructedShards = append(reconstructedShards, missedShard)
+		}
 	}
+
+	return storedData, reconstructedShards, nil
 }
 
 /**
@@ -341,15 +439,35 @@ func deleteController(ctx echo.Context) error {
 		nameList = append(nameList, file.Name)
 	}
 
+	if err := deleteFiles(clowdee.GoogleID, nameList...); err != nil {
+		return ctx.NoContent(http.StatusInternalServerError)
+	}
+
+	return ctx.NoContent(http.StatusNoContent)
+}
+
+/**
+Delete the files of the clowdee from the database and the nodes.
+*/
+func deleteFiles(googleID string, fileNames ...string) error {
 	delQ := operationq.NewDelQ()
 
 	// add deletion list to delete queue
-	if err := delQ.Push(clowdee.GoogleID, nameList...); err != nil {
+	if err := delQ.Push(googleID, fileNames...); err != nil {
 		if err != operationq.ErrFileNotExist {
-			return ctx.NoContent(http.StatusInternalServerError)
+			return err
 		}
 	}
 
+	dispatchDeletion(delQ)
+
+	return nil
+}
+
+/**
+Delete the files in the delete queue from the database and the nodes.
+*/
+func dispatchDeletion(delQ *operationq.DeleteQueue) {
 	// schedule every shards for deletion to the each active nodes
 	// and get quotas for each nodes
 	quotas := delQ.Schedule()
@@ -370,6 +488,4 @@ func deleteController(ctx echo.Context) error {
 			}
 		}
 	}
-
-	return ctx.NoContent(http.StatusNoContent)
 }
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"github.com/team836/clowd-storage/internal/model"
+	"github.com/team836/clowd-storage/pkg/encrypt"
+)
+
+/**
+Encrypt the segment data with new data key and record the active master key on the file model.
+The data key is returned to be wrapped after the file record is created,
+because the wrapped key is bound to the file id.
+*/
+func sealSegment(fileModel *model.File, data []byte) (sealed, dataKey []byte, err error) {
+	keyRing, err := encrypt.Keys()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyID, _ := keyRing.Active()
+
+	dataKey, err = encrypt.NewDataKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c, err := encrypt.NewCipher(dataKey, fileModel.DataAAD())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fileModel.KeyID = keyID
+
+	return c.Seal(data), dataKey, nil
+}
+
+/**
+Create the cipher of the segment by unwrapping its data key.
+*/
+func segmentCipher(fileModel *model.File) (*encrypt.Cipher, error) {
+	keyRing, err := encrypt.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	// the data key can be wrapped by the old master key during the rotation
+	masterKey, err := keyRing.Find(fileModel.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := encrypt.UnwrapKey(fileModel.WrappedKey, masterKey, fileModel.KeyAAD(fileModel.KeyID))
+	if err != nil {
+		return nil, err
+	}
+
+	return encrypt.NewCipher(dataKey, fileModel.DataAAD())
+}
+
+/**
+Decrypt the whole stored data of the segment.
+The segment which is not encrypted is returned as it is.
+*/
+func openSegment(fileModel *model.File, stored []byte) ([]byte, error) {
+	if !fileModel.IsEncrypted() {
+		return stored, nil
+	}
+
+	c, err := segmentCipher(fileModel)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Open(stored)
+}
@@ -0,0 +1,313 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/team836/clowd-storage/internal/model"
+	"github.com/team836/clowd-storage/internal/module/operationq"
+	"github.com/team836/clowd-storage/internal/module/repair"
+	"github.com/team836/clowd-storage/pkg/database"
+	"github.com/team836/clowd-storage/pkg/encrypt"
+	"github.com/team836/clowd-storage/pkg/logger"
+)
+
+var (
+	errInvalidRange = errors.New("invalid range")
+
+	errUnsatisfiableRange = errors.New("unsatisfiable range")
+)
+
+/**
+Byte range of the file (inclusive).
+*/
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+/**
+Single file download requested by client(clowdee) with `Range` header support.
+
+- Find all segments of the file.
+- Find the segments which cover the requested byte range.
+- Load only the data shards which cover the range in each segment.
+- If any of them is missing or corrupted, load all shards of the segment and decode them.
+- Respond the range as binary data.
+*/
+func rangeDownloadController(ctx echo.Context) error {
+	clowdee := ctx.Get("clowdee").(*model.Clowdee)
+
+	name, err := url.PathUnescape(ctx.Param("name"))
+	if err != nil {
+		return ctx.String(http.StatusBadRequest, "Invalid file name")
+	}
+
+	// find all segments of the file which are ordered by its position
+	segments := make([]*model.File, 0)
+	sqlResult := database.Conn().
+		Where(&model.File{GoogleID: clowdee.GoogleID, Name: name}).
+		Order("position asc").
+		Find(&segments)
+
+	if sqlResult.Error != nil && !sqlResult.RecordNotFound() {
+		logger.File().Errorf("Error finding the file in database, %s", sqlResult.Error.Error())
+		return ctx.NoContent(http.StatusInternalServerError)
+	}
+
+	if len(segments) == 0 {
+		return ctx.String(http.StatusNotFound, operationq.ErrFileNotExist.Error()+": "+name)
+	}
+
+	var totalSize int64
+	for _, segment := range segments {
+		totalSize += int64(segment.Size)
+	}
+
+	header := ctx.Response().Header()
+	header.Set("Accept-Ranges", "bytes")
+	header.Set(echo.HeaderContentType, echo.MIMEOctetStream)
+
+	// without range, respond whole file
+	status := http.StatusOK
+	requested := &byteRange{start: 0, end: totalSize - 1}
+
+	if rangeHeader := ctx.Request().Header.Get("Range"); rangeHeader != "" {
+		parsed, err := parseRange(rangeHeader, totalSize)
+		switch err {
+		case nil:
+			status = http.StatusPartialContent
+			requested = parsed
+			header.Set(
+				"Content-Range",
+				"bytes "+strconv.FormatInt(requested.start, 10)+"-"+
+					strconv.FormatInt(requested.end, 10)+"/"+strconv.FormatInt(totalSize, 10),
+			)
+		case errUnsatisfiableRange:
+			header.Set("Content-Range", "bytes */"+strconv.FormatInt(totalSize, 10))
+			return ctx.NoContent(http.StatusRequestedRangeNotSatisfiable)
+		default:
+			// ignore the range which is not supported
+		}
+	}
+
+	header.Set(echo.HeaderContentLength, strconv.FormatInt(requested.end-requested.start+1, 10))
+	ctx.Response().WriteHeader(status)
+
+	reconstructedShards := make([]*model.ShardToLoad, 0)
+	defer func() {
+		go repair.Restore(reconstructedShards)
+	}()
+
+	// write every segments which cover the range
+	var offset int64
+	for _, segment := range segments {
+		segmentStart, segmentEnd := offset, offset+int64(segment.Size)-1
+		offset += int64(segment.Size)
+
+		// not overlapped with the range
+		if segmentEnd < requested.start || segmentStart > requested.end {
+			continue
+		}
+
+		// convert to the range in the segment
+		from := max64(requested.start, segmentStart) - segmentStart
+		to := min64(requested.end, segmentEnd) - segmentStart
+
+		data, missedShards, err := readPlainSegment(ctx.Request().Context(), segment, int(from), int(to))
+		if err != nil {
+			// the header is already sent, so just abort the response
+			logger.File().Infof("Error reading the segment, %s", err)
+			return err
+		}
+
+		reconstructedShards = append(reconstructedShards, missedShards...)
+
+		if _, err := ctx.Response().Write(data); err != nil {
+			logger.File().Infof("Error writing the segment to client, %s", err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+/**
+Read the original segment data between `from` and `to`(inclusive).
+If the segment is encrypted, read only the sealed chunks which cover the range and decrypt them.
+*/
+func readPlainSegment(reqCtx context.Context, segment *model.File, from, to int) ([]byte, []*model.ShardToLoad, error) {
+	if !segment.IsEncrypted() {
+		return readSegment(reqCtx, segment, from, to)
+	}
+
+	// convert to the range of the sealed chunks
+	firstChunk, lastChunk := from/encrypt.ChunkSize, to/encrypt.ChunkSize
+	sealedFrom := firstChunk * encrypt.SealedChunkSize
+	sealedTo := (lastChunk+1)*encrypt.SealedChunkSize - 1
+	if sealedTo >= segment.StoredSize() {
+		sealedTo = segment.StoredSize() - 1
+	}
+
+	sealed, missedShards, err := readSegment(reqCtx, segment, sealedFrom, sealedTo)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c, err := segmentCipher(segment)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	plain, err := c.OpenChunks(sealed, firstChunk, encrypt.ChunkCount(int(segment.Size)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	offset := firstChunk * encrypt.ChunkSize
+	return plain[from-offset : to-offset+1], missedShards, nil
+}
+
+/**
+Read the stored segment data between `from` and `to`(inclusive).
+
+Load only the data shards which cover the range first.
+If any of them is missing or corrupted, fall back to load all shards of the segment
+and return the missed shards with their reconstructed data for restoring.
+*/
+func readSegment(reqCtx context.Context, segment *model.File, from, to int) ([]byte, []*model.ShardToLoad, error) {
+	shardSize := segment.ErasureProfile().ShardSize(segment.StoredSize())
+	firstShard, lastShard := from/shardSize, to/shardSize
+
+	dq := operationq.NewDQ()
+	if err := dq.PushSegmentShards(segment, firstShard, lastShard); err != nil {
+		return nil, nil, err
+	}
+
+	// download the data shards which cover the range
+	dq.Load(reqCtx)
+
+	loadedShards := dq.Files[0].Shards
+	if isIntact(loadedShards, lastShard-firstShard+1) {
+		data := make([]byte, 0, (lastShard-firstShard+1)*shardSize)
+		for _, loadedShard := range loadedShards {
+			data = append(data, loadedShard.Data...)
+		}
+
+		offset := firstShard * shardSize
+		return data[from-offset : to-offset+1], nil, nil
+	}
+
+	// fall back to decode the whole segment
+	dq = operationq.NewDQ()
+	if err := dq.PushSegment(segment); err != nil {
+		return nil, nil, err
+	}
+
+	dq.Load(reqCtx)
+
+	data, missedShards, err := decodeStoredSegment(dq.Files[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data[from : to+1], missedShards, nil
+}
+
+/**
+Check whether if all of the expected shards are loaded without corruption.
+*/
+func isIntact(shards []*model.ShardToLoad, expected int) bool {
+	if len(shards) != expected {
+		return false
+	}
+
+	for _, shard := range shards {
+		if shard.Data == nil {
+			return false
+		}
+	}
+
+	return true
+}
+
+/**
+Parse the single byte range of the `Range` header.
+(See https://tools.ietf.org/html/rfc7233#section-2.1 document)
+*/
+func parseRange(header string, size int64) (*byteRange, error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return nil, errInvalidRange
+	}
+
+	spec := strings.TrimSpace(header[len(prefix):])
+
+	// multiple ranges are not supported
+	if strings.Contains(spec, ",") {
+		return nil, errInvalidRange
+	}
+
+	dash := strings.Index(spec, "-")
+	if dash < 0 {
+		return nil, errInvalidRange
+	}
+
+	startSpec, endSpec := strings.TrimSpace(spec[:dash]), strings.TrimSpace(spec[dash+1:])
+
+	// suffix range such as `bytes=-500`
+	if startSpec == "" {
+		suffix, err := strconv.ParseInt(endSpec, 10, 64)
+		if err != nil || suffix < 0 {
+			return nil, errInvalidRange
+		}
+
+		if suffix == 0 || size == 0 {
+			return nil, errUnsatisfiableRange
+		}
+
+		return &byteRange{start: max64(size-suffix, 0), end: size - 1}, nil
+	}
+
+	start, err := strconv.ParseInt(startSpec, 10, 64)
+	if err != nil || start < 0 {
+		return nil, errInvalidRange
+	}
+
+	if start >= size {
+		return nil, errUnsatisfiableRange
+	}
+
+	// open range such as `bytes=500-`
+	end := size - 1
+	if endSpec != "" {
+		if end, err = strconv.ParseInt(endSpec, 10, 64); err != nil || end < start {
+			return nil, errInvalidRange
+		}
+
+		end = min64(end, size-1)
+	}
+
+	return &byteRange{start: start, end: end}, nil
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,43 @@
+package client
+
+import "testing"
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		size    int64
+		want    *byteRange
+		wantErr error
+	}{
+		{"closed", "bytes=0-499", 1000, &byteRange{start: 0, end: 499}, nil},
+		{"single byte", "bytes=10-10", 1000, &byteRange{start: 10, end: 10}, nil},
+		{"open", "bytes=500-", 1000, &byteRange{start: 500, end: 999}, nil},
+		{"end over size", "bytes=900-2000", 1000, &byteRange{start: 900, end: 999}, nil},
+		{"suffix", "bytes=-200", 1000, &byteRange{start: 800, end: 999}, nil},
+		{"suffix over size", "bytes=-2000", 1000, &byteRange{start: 0, end: 999}, nil},
+		{"spaces", "bytes= 1 - 2 ", 1000, &byteRange{start: 1, end: 2}, nil},
+		{"other unit", "items=0-1", 1000, nil, errInvalidRange},
+		{"multiple ranges", "bytes=0-1,5-6", 1000, nil, errInvalidRange},
+		{"without dash", "bytes=100", 1000, nil, errInvalidRange},
+		{"not a number", "bytes=a-b", 1000, nil, errInvalidRange},
+		{"negative start", "bytes=-1-5", 1000, nil, errInvalidRange},
+		{"end before start", "bytes=500-100", 1000, nil, errInvalidRange},
+		{"start at size", "bytes=1000-", 1000, nil, errUnsatisfiableRange},
+		{"zero suffix", "bytes=-0", 1000, nil, errUnsatisfiableRange},
+		{"suffix of empty file", "bytes=-1", 0, nil, errUnsatisfiableRange},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseRange(test.header, test.size)
+			if err != test.wantErr {
+				t.Fatalf("parseRange() error = %v, want %v", err, test.wantErr)
+			}
+
+			if test.want != nil && *got != *test.want {
+				t.Errorf("parseRange() = %+v, want %+v", *got, *test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package client
+
+import (
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/spf13/viper"
+	"github.com/team836/clowd-storage/internal/model"
+	"github.com/team836/clowd-storage/internal/module/operationq"
+	"github.com/team836/clowd-storage/pkg/errcorr"
+	"github.com/team836/clowd-storage/pkg/logger"
+)
+
+/**
+Binary file upload requested by client(clowdee).
+
+The request body is `multipart/form-data` which has file parts,
+or raw `application/octet-stream` whose file name is given by `name` query parameter.
+Unlike the json upload, file data is not base64 encoded.
+The erasure profile can be chosen by `profile` query parameter.
+
+The server cuts each file into fixed-size segments while reading the body.
+Every segment is encoded and saved as its own file record in order of the position,
+so the memory usage is bounded by the segment size regardless of the file size.
+*/
+func streamUploadController(ctx echo.Context) error {
+	clowdee := ctx.Get("clowdee").(*model.Clowdee)
+
+	// find the erasure profile which the clowdee chooses
+	profile, err := errcorr.FindProfile(ctx.QueryParam("profile"))
+	if err != nil {
+		logger.File().Infof("Error finding the erasure profile, %s", err)
+		return ctx.String(http.StatusNotAcceptable, "Cannot use the erasure profile: "+ctx.QueryParam("profile"))
+	}
+
+	mediaType, _, err := mime.ParseMediaType(ctx.Request().Header.Get(echo.HeaderContentType))
+	if err != nil {
+		return ctx.String(http.StatusUnsupportedMediaType, "Invalid content type")
+	}
+
+	switch mediaType {
+	case echo.MIMEMultipartForm:
+		return uploadMultipart(ctx, clowdee, profile)
+	case echo.MIMEOctetStream:
+		name := ctx.QueryParam("name")
+		if name == "" {
+			return ctx.String(http.StatusBadRequest, "Cannot find the file name at the query parameters")
+		}
+
+		if err := saveStream(clowdee, name, profile, ctx.Request().Body); err != nil {
+			return respondStreamError(ctx, name, err)
+		}
+
+		return ctx.NoContent(http.StatusCreated)
+	default:
+		return ctx.String(http.StatusUnsupportedMediaType, "Unsupported content type: "+mediaType)
+	}
+}
+
+/**
+Upload every file parts of the multipart body in order.
+*/
+func uploadMultipart(ctx echo.Context, clowdee *model.Clowdee, profile *errcorr.Profile) error {
+	reader, err := ctx.Request().MultipartReader()
+	if err != nil {
+		logger.File().Infof("Error reading client's multipart body, %s", err)
+		return ctx.String(http.StatusBadRequest, "Invalid multipart body")
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logger.File().Infof("Error reading client's multipart body, %s", err)
+			return ctx.String(http.StatusBadRequest, "Invalid multipart body")
+		}
+
+		// skip the non-file fields
+		if part.FileName() == "" {
+			continue
+		}
+
+		if err := saveStream(clowdee, part.FileName(), profile, part); err != nil {
+			return respondStreamError(ctx, part.FileName(), err)
+		}
+	}
+
+	return ctx.NoContent(http.StatusCreated)
+}
+
+/**
+Cut the file data from the stream into segments,
+and encode and save each segment to the nodes.
+
+When any segment cannot be saved, the segments which are already saved by this stream are deleted.
+*/
+func saveStream(clowdee *model.Clowdee, name string, profile *errcorr.Profile, stream io.Reader) error {
+	segmentSize := viper.GetInt64("UPLOAD.SEGMENT_SIZE")
+
+	// file records of the segments which are saved by this stream
+	saved := make([]*model.File, 0)
+
+	// the segment buffer is never grown over the segment size, and it is reused
+	// because the shards are made from the encrypted copy of the segment
+	segment := make([]byte, segmentSize)
+
+	var position int
+	for ; ; position++ {
+		n, err := io.ReadFull(stream, segment)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			logger.File().Infof("Error reading client's uploaded file, %s", err)
+			return rollbackStream(saved, errInvalidFile)
+		}
+
+		// reach at the end of the file
+		if n == 0 {
+			break
+		}
+
+		fileModel, err := saveSegment(clowdee, name, position, profile, segment[:n])
+		if err != nil {
+			return rollbackStream(saved, err)
+		}
+		saved = append(saved, fileModel)
+
+		// reach at the last segment
+		if int64(n) < segmentSize {
+			position++
+			break
+		}
+	}
+
+	// empty file
+	if position == 0 {
+		return errInvalidFile
+	}
+
+	return nil
+}
+
+/**
+Encrypt and encode the segment and save it to the nodes.
+Return the file record of the saved segment.
+*/
+func saveSegment(
+	clowdee *model.Clowdee,
+	name string,
+	position int,
+	profile *errcorr.Profile,
+	segment []byte,
+) (*model.File, error) {
+	encFile, err := encodeFile(clowdee, name, position, profile, segment)
+	if err != nil {
+		return nil, err
+	}
+
+	uq := operationq.NewUQ()
+	uq.Push(encFile)
+
+	if err := saveFiles(uq); err != nil {
+		return nil, err
+	}
+
+	return encFile.Model, nil
+}
+
+/**
+Delete the segments which are saved by this stream and return the cause.
+The other records of the same name, e.g. saved by another upload, are not touched.
+*/
+func rollbackStream(saved []*model.File, cause error) error {
+	if len(saved) == 0 {
+		return cause
+	}
+
+	delQ := operationq.NewDelQ()
+	if err := delQ.PushFiles(saved...); err != nil {
+		logger.File().Errorf("Error deleting the partially uploaded file, %s", err)
+		return cause
+	}
+
+	dispatchDeletion(delQ)
+
+	return cause
+}
+
+/**
+Respond the error which is occurred while saving the streamed file.
+*/
+func respondStreamError(ctx echo.Context, name string, err error) error {
+	if err == errInvalidFile {
+		return ctx.String(http.StatusNotAcceptable, "Cannot handle this file: "+name)
+	}
+
+	return respondUploadError(ctx, err)
+}
@@ -0,0 +1,240 @@
+package clowder
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo/v4"
+	"github.com/team836/clowd-storage/internal/model"
+	"github.com/team836/clowd-storage/internal/module/drain"
+	"github.com/team836/clowd-storage/internal/module/reputation"
+	"github.com/team836/clowd-storage/internal/module/spool"
+	"github.com/team836/clowd-storage/pkg/database"
+	"github.com/team836/clowd-storage/pkg/logger"
+)
+
+const (
+	// max storage allocation which can be declared (GiB)
+	maxAllocation = 1<<16 - 1
+)
+
+type nodeView struct {
+	MachineID          string             `json:"machineId"`
+	Zone               *string            `json:"zone"` // null if not declared
+	State              model.NodeState    `json:"state"`
+	Active             bool               `json:"active"`
+	LastSeenAt         time.Time          `json:"lastSeenAt"`
+	MaxCapacity        *uint16            `json:"maxCapacity"` // GiB, null if not declared
+	Assigned           uint64             `json:"assigned"`    // bytes of the shards on the node
+	CapacitySuspicious bool               `json:"capacitySuspicious"`
+	Reputation         *reputation.Report `json:"reputation"` // null if the node has never connected
+	Protocol           uint16             `json:"protocol"`   // 0 if the node has never sent the hello
+	Software           string             `json:"software"`
+}
+
+type capacityOnClowder struct {
+	MaxCapacity uint `json:"maxCapacity"` // GiB
+}
+
+type assignedBytes struct {
+	MachineID string
+	Total     uint64
+}
+
+func RegisterHandlers(group *echo.Group) {
+	group.GET("/nodes", nodeListController)
+	group.POST("/nodes/:mid/drain", drainController)
+	group.GET("/nodes/:mid/drain", drainProgressController)
+	group.PUT("/nodes/:mid/capacity", capacityController)
+}
+
+/**
+Node list with the reputation requested by clowder.
+*/
+func nodeListController(ctx echo.Context) error {
+	clowder := ctx.Get("clowder").(*model.Clowder)
+
+	// find from database
+	nodes := make([]*model.Node, 0)
+	sqlResult := database.Conn().
+		Where("clowder_google_id = ?", clowder.GoogleID).
+		Find(&nodes)
+
+	// sql error occurred
+	if sqlResult.Error != nil && !sqlResult.RecordNotFound() {
+		logger.File().Errorf("Error finding the clowder's node list in database, %s", sqlResult.Error.Error())
+		return ctx.NoContent(http.StatusInternalServerError)
+	}
+
+	machineIDs := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		machineIDs = append(machineIDs, node.MachineID)
+	}
+
+	reports, err := reputation.FindReports(machineIDs)
+	if err != nil {
+		logger.File().Errorf("Error finding the reputation of the nodes, %s", err)
+		return ctx.NoContent(http.StatusInternalServerError)
+	}
+
+	// sum the shards on each nodes
+	assignedList := make([]*assignedBytes, 0)
+	if len(machineIDs) != 0 {
+		sqlResult = database.Conn().
+			Table("shards").
+			Select("machine_id, sum(size) as total").
+			Where("machine_id IN (?)", machineIDs).
+			Group("machine_id").
+			Scan(&assignedList)
+
+		if sqlResult.Error != nil && !sqlResult.RecordNotFound() {
+			logger.File().Errorf("Error summing the shards of the nodes, %s", sqlResult.Error.Error())
+			return ctx.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	assigned := make(map[string]uint64)
+	for _, bytes := range assignedList {
+		assigned[bytes.MachineID] = bytes.Total
+	}
+
+	nodeList := make([]*nodeView, 0, len(nodes))
+	for _, node := range nodes {
+		view := &nodeView{
+			MachineID:          node.MachineID,
+			State:              node.State,
+			Active:             spool.Pool().FindActiveNode(node.MachineID) != nil,
+			LastSeenAt:         node.LastSeenAt,
+			Assigned:           assigned[node.MachineID],
+			CapacitySuspicious: node.CapacitySuspicious,
+			Reputation:         reports[node.MachineID],
+			Protocol:           node.ProtocolVersion,
+			Software:           node.SoftwareVersion,
+		}
+
+		if node.Zone != "" {
+			zone := node.Zone
+			view.Zone = &zone
+		}
+
+		if node.CapacityDeclaredAt != nil {
+			maxCapacity := node.MaxCapacity
+			view.MaxCapacity = &maxCapacity
+		}
+
+		nodeList = append(nodeList, view)
+	}
+
+	return ctx.JSON(http.StatusOK, &nodeList)
+}
+
+/**
+Start draining the node requested by clowder.
+The shards on the node are migrated to the other nodes,
+and then the node is decommissioned.
+*/
+func drainController(ctx echo.Context) error {
+	node, err := findOwnNode(ctx)
+	if node == nil {
+		return err
+	}
+
+	progress, err := drain.Start(node.MachineID)
+	if err != nil {
+		switch err {
+		case drain.ErrNodeNotActive, drain.ErrCannotDrain, drain.ErrAlreadyDraining:
+			return ctx.String(http.StatusConflict, err.Error())
+		default:
+			logger.File().Errorf("Error starting the drain, %s", err)
+			return ctx.NoContent(http.StatusInternalServerError)
+		}
+	}
+
+	return ctx.JSON(http.StatusAccepted, progress)
+}
+
+/**
+Progress of the drain requested by clowder.
+*/
+func drainProgressController(ctx echo.Context) error {
+	node, err := findOwnNode(ctx)
+	if node == nil {
+		return err
+	}
+
+	progress, err := drain.Find(node)
+	if err != nil {
+		logger.File().Errorf("Error finding the drain progress, %s", err)
+		return ctx.NoContent(http.StatusInternalServerError)
+	}
+
+	if progress == nil {
+		return ctx.String(http.StatusNotFound, "The node is not drained")
+	}
+
+	return ctx.JSON(http.StatusOK, progress)
+}
+
+/**
+Declare the storage allocation of the node requested by clowder.
+No more shards are placed on the node beyond the allocation.
+*/
+func capacityController(ctx echo.Context) error {
+	node, err := findOwnNode(ctx)
+	if node == nil {
+		return err
+	}
+
+	capacity := &capacityOnClowder{}
+	if err := ctx.Bind(capacity); err != nil {
+		return ctx.String(http.StatusBadRequest, "Cannot bind the capacity")
+	}
+
+	if capacity.MaxCapacity == 0 || capacity.MaxCapacity > maxAllocation {
+		return ctx.String(http.StatusBadRequest, "The max capacity must be between 1 and 65535 GiB")
+	}
+
+	maxCapacity, declaredAt := uint16(capacity.MaxCapacity), time.Now()
+	err = database.Conn().
+		Model(node).
+		Updates(map[string]interface{}{"max_capacity": maxCapacity, "capacity_declared_at": declaredAt}).
+		Error
+
+	if err != nil {
+		logger.File().Errorf("Error declaring the capacity of the node, %s", err.Error())
+		return ctx.NoContent(http.StatusInternalServerError)
+	}
+
+	// apply to the connected node immediately
+	if activeNode := spool.Pool().FindActiveNode(node.MachineID); activeNode != nil {
+		activeNode.SetAllocation(maxCapacity, &declaredAt)
+	}
+
+	return ctx.NoContent(http.StatusNoContent)
+}
+
+/**
+Find the node of the current clowder by the machine id in the path.
+If the node is not found, respond the error and return nil.
+*/
+func findOwnNode(ctx echo.Context) (*model.Node, error) {
+	clowder := ctx.Get("clowder").(*model.Clowder)
+
+	node := &model.Node{}
+	err := database.Conn().
+		Where("machine_id = ? AND clowder_google_id = ?", ctx.Param("mid"), clowder.GoogleID).
+		First(node).
+		Error
+
+	if err != nil {
+		if gorm.IsRecordNotFoundError(err) {
+			return nil, ctx.String(http.StatusNotFound, "Cannot find the node")
+		}
+
+		logger.File().Errorf("Error finding the node in database, %s", err.Error())
+		return nil, ctx.NoContent(http.StatusInternalServerError)
+	}
+
+	return node, nil
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
 	"github.com/team836/clowd-storage/internal/model"
+	"github.com/team836/clowd-storage/pkg/frame"
 	"github.com/team836/clowd-storage/pkg/logger"
 )
 
@@ -17,6 +18,9 @@ var (
 	upgrader = websocket.Upgrader{
 		ReadBufferSize:  512,
 		WriteBufferSize: 512,
+		// binary frames are preferred, and the json is the fallback for older nodes
+		// The node which offers no subprotocol uses the json without the handshake.
+		Subprotocols: []string{frame.Subprotocol, frame.JSONSubprotocol},
 		CheckOrigin: func(r *http.Request) bool {
 			return true
 		},
@@ -33,14 +37,6 @@ Handle the websocket requests from the node.
 func openWebsocket(ctx echo.Context) error {
 	nodeModel := ctx.Get("node").(*model.Node) // get current node model
 
-	// find duplicate node connection and unregistered old one
-	for node := range spool.Pool().Nodes {
-		if node.Model.MachineID == nodeModel.MachineID {
-			spool.Pool().Unregister <- node
-			break
-		}
-	}
-
 	// upgrade to websocket protocol
 	conn, err := upgrader.Upgrade(ctx.Response(), ctx.Request(), nil)
 	if err != nil {
@@ -48,11 +44,24 @@ func openWebsocket(ctx echo.Context) error {
 		return err
 	}
 
+	// exchange the hello message before any operation
+	// The connection is already closed with the close code if it fails.
+	hello, err := spool.Handshake(conn)
+	if err != nil {
+		logger.File().Infof("Error handshaking with the node(%s), %s", nodeModel.MachineID, err)
+		return nil
+	}
+
+	if err := spool.RecordHello(nodeModel, hello); err != nil {
+		logger.File().Errorf("Error recording the hello of the node, %s", err)
+	}
+
 	// create new node
-	node := spool.NewActiveNode(conn, nodeModel)
+	node := spool.NewActiveNode(conn, nodeModel, hello)
 
-	go node.Run()                 // run the websocket operations
-	spool.Pool().Register <- node // register this node to pool
+	// register this node to pool, the duplicate connection of same machine is replaced
+	spool.Pool().Register(node)
+	go node.Run() // run the websocket operations
 
 	return nil
 }
@@ -36,6 +36,20 @@ func PrepareNodeModel(next echo.HandlerFunc) echo.HandlerFunc {
 			return ctx.NoContent(http.StatusInternalServerError)
 		}
 
+		// the retired node cannot be connected again
+		if node.State == model.NodeDecommissioned {
+			return ctx.String(http.StatusForbidden, "The node is already decommissioned")
+		}
+
+		// update the failure zone if the clowder declares it, the empty zone clears it
+		// the zone is kept when the parameter is absent
+		if zones, ok := ctx.QueryParams()["zone"]; ok && zones[0] != node.Zone {
+			if err := database.Conn().Model(node).Update("zone", zones[0]).Error; err != nil {
+				logger.File().Errorf("Error updating the node's zone, %s", err.Error())
+				return ctx.NoContent(http.StatusInternalServerError)
+			}
+		}
+
 		ctx.Set("node", node)
 
 		return next(ctx)
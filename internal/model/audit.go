@@ -0,0 +1,78 @@
+package model
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/team836/clowd-storage/pkg/database"
+	"github.com/team836/clowd-storage/pkg/errcorr"
+)
+
+const (
+	auditNonceSize = 16
+)
+
+type AuditChallenge struct {
+	// column fields
+	ID        uint   `gorm:"type:int(11) unsigned auto_increment;primary_key"`
+	ShardName string `gorm:"type:varchar(255);not null;index"`
+	Nonce     string `gorm:"type:char(32);not null"` // hex encoded
+	Expected  string `gorm:"type:char(64);not null"` // hex encoded keyed checksum
+	Used      bool   `gorm:"not null;default:false"`
+}
+
+type AuditResult struct {
+	// column fields
+	ID        uint      `gorm:"type:int(11) unsigned auto_increment;primary_key"`
+	MachineID string    `gorm:"type:varchar(255);not null;index"`
+	ShardName string    `gorm:"type:varchar(255);not null"`
+	Passed    bool      `gorm:"not null"`
+	CheckedAt time.Time `gorm:"type:datetime;not null;default:current_timestamp"`
+}
+
+/**
+Migrate audit challenge table.
+*/
+func MigrateAuditChallenge() {
+	database.
+		Conn().
+		Set("gorm:table_options", "CHARSET=utf8mb4").
+		AutoMigrate(&AuditChallenge{}).
+		Model(&AuditChallenge{}).
+		AddForeignKey("shard_name", "shards(name)", "CASCADE", "CASCADE")
+}
+
+/**
+Migrate audit result table.
+*/
+func MigrateAuditResult() {
+	database.
+		Conn().
+		Set("gorm:table_options", "CHARSET=utf8mb4").
+		AutoMigrate(&AuditResult{}).
+		Model(&AuditResult{}).
+		AddForeignKey("machine_id", "nodes(machine_id)", "CASCADE", "CASCADE")
+}
+
+/**
+Precompute the audit challenges of the shard with random nonces.
+The expected answers are computed while the server still has the shard data.
+*/
+func NewAuditChallenges(shardName string, data []byte, count int) ([]*AuditChallenge, error) {
+	challenges := make([]*AuditChallenge, 0, count)
+	for i := 0; i < count; i++ {
+		nonce := make([]byte, auditNonceSize)
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+
+		challenges = append(challenges, &AuditChallenge{
+			ShardName: shardName,
+			Nonce:     hex.EncodeToString(nonce),
+			Expected:  errcorr.KeyedChecksum(data, nonce),
+		})
+	}
+
+	return challenges, nil
+}
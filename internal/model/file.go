@@ -1,14 +1,19 @@
 package model
 
 import (
+	"encoding/binary"
 	"time"
 
+	"github.com/jinzhu/gorm"
 	"github.com/team836/clowd-storage/pkg/database"
+	"github.com/team836/clowd-storage/pkg/encrypt"
+	"github.com/team836/clowd-storage/pkg/errcorr"
 )
 
 type EncFile struct {
-	Model *File
-	Data  [][]byte
+	Model   *File
+	Data    [][]byte
+	DataKey []byte // wrapped after the file record is created, nil if the file is not encrypted
 }
 
 type FileToLoad struct {
@@ -25,6 +30,15 @@ type File struct {
 	Size       uint      `gorm:"type:int(11) unsigned;not null"`
 	UploadedAt time.Time `gorm:"type:datetime;not null;default:current_timestamp"`
 
+	// erasure coding profile
+	Profile      string `gorm:"type:varchar(63);not null;default:'default'"`
+	DataShards   uint8  `gorm:"type:tinyint(3) unsigned;not null;default:30"`
+	ParityShards uint8  `gorm:"type:tinyint(3) unsigned;not null;default:20"`
+
+	// data key wrapped by the master key, empty if the file is not encrypted
+	WrappedKey []byte `gorm:"type:varbinary(255)"`
+	KeyID      uint16 `gorm:"type:smallint(5) unsigned;not null;default:1;index"` // id of the master key
+
 	// associations fields
 	Shards []Shard `gorm:"foreignkey:FileID;association_foreignkey:ID"` // files has many shards
 }
@@ -40,3 +54,100 @@ func MigrateFile() {
 		Model(&File{}).
 		AddForeignKey("google_id", "clowdees(google_id)", "RESTRICT", "CASCADE")
 }
+
+/**
+Return the erasure profile which the file is encoded with.
+*/
+func (file *File) ErasureProfile() *errcorr.Profile {
+	return &errcorr.Profile{
+		Name:         file.Profile,
+		DataShards:   int(file.DataShards),
+		ParityShards: int(file.ParityShards),
+	}
+}
+
+/**
+Record the erasure profile which the file is encoded with.
+*/
+func (file *File) SetErasureProfile(profile *errcorr.Profile) {
+	file.Profile = profile.Name
+	file.DataShards = uint8(profile.DataShards)
+	file.ParityShards = uint8(profile.ParityShards)
+}
+
+/**
+Check whether if the file data is encrypted.
+*/
+func (file *File) IsEncrypted() bool {
+	return len(file.WrappedKey) != 0
+}
+
+/**
+Return the associated data of the wrapped data key.
+It binds the wrapped key to the file id and the id of the master key which wraps it,
+so the wrapped key cannot be moved to the other file or labeled with the other master key.
+*/
+func (file *File) KeyAAD(keyID uint16) []byte {
+	aad := make([]byte, 10)
+	binary.BigEndian.PutUint64(aad, uint64(file.ID))
+	binary.BigEndian.PutUint16(aad[8:], keyID)
+
+	return aad
+}
+
+/**
+Return the associated data of the sealed chunks.
+The file id is not assigned yet when the data is sealed,
+so the chunks are bound to the unique owner, name and position of the file instead.
+*/
+func (file *File) DataAAD() []byte {
+	aad := make([]byte, 0, 2*binary.MaxVarintLen64+len(file.GoogleID)+len(file.Name)+2)
+	aad = appendLengthPrefixed(aad, file.GoogleID)
+	aad = appendLengthPrefixed(aad, file.Name)
+
+	return append(aad, byte(uint16(file.Position)>>8), byte(file.Position))
+}
+
+func appendLengthPrefixed(dst []byte, field string) []byte {
+	length := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(length, uint64(len(field)))
+
+	return append(append(dst, length[:n]...), field...)
+}
+
+/**
+Wrap the data key of the file with its master key and record the wrapped key.
+The key is bound to the file id, so this should be called after the file record is created.
+*/
+func (file *EncFile) WrapKey(tx *gorm.DB) error {
+	keyRing, err := encrypt.Keys()
+	if err != nil {
+		return err
+	}
+
+	masterKey, err := keyRing.Find(file.Model.KeyID)
+	if err != nil {
+		return err
+	}
+
+	wrappedKey, err := encrypt.WrapKey(file.DataKey, masterKey, file.Model.KeyAAD(file.Model.KeyID))
+	if err != nil {
+		return err
+	}
+
+	file.Model.WrappedKey = wrappedKey
+
+	return tx.Model(file.Model).UpdateColumn("wrapped_key", wrappedKey).Error
+}
+
+/**
+Return the size of the data which is actually stored as shards.
+The size field is always the size of the original data.
+*/
+func (file *File) StoredSize() int {
+	if file.IsEncrypted() {
+		return encrypt.SealedSize(int(file.Size))
+	}
+
+	return int(file.Size)
+}
@@ -0,0 +1,33 @@
+package model
+
+import (
+	"time"
+
+	"github.com/team836/clowd-storage/pkg/database"
+)
+
+type NodeReputation struct {
+	// column fields
+	MachineID          string    `gorm:"type:varchar(255);primary_key"`
+	Saves              uint      `gorm:"type:int(11) unsigned;not null;default:0"`
+	FailedSaves        uint      `gorm:"type:int(11) unsigned;not null;default:0"`
+	Loads              uint      `gorm:"type:int(11) unsigned;not null;default:0"`
+	FailedLoads        uint      `gorm:"type:int(11) unsigned;not null;default:0"`
+	ChecksumMismatches uint      `gorm:"type:int(11) unsigned;not null;default:0"`
+	AuditsPassed       uint      `gorm:"type:int(11) unsigned;not null;default:0"`
+	AuditsFailed       uint      `gorm:"type:int(11) unsigned;not null;default:0"`
+	FailureRate        float64   `gorm:"type:double;not null;default:0"` // smoothed failure rate of the recent operations
+	FirstSeenAt        time.Time `gorm:"type:datetime;not null;default:current_timestamp"`
+}
+
+/**
+Migrate node reputation table.
+*/
+func MigrateNodeReputation() {
+	database.
+		Conn().
+		Set("gorm:table_options", "CHARSET=utf8mb4").
+		AutoMigrate(&NodeReputation{}).
+		Model(&NodeReputation{}).
+		AddForeignKey("machine_id", "nodes(machine_id)", "CASCADE", "CASCADE")
+}
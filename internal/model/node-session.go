@@ -0,0 +1,27 @@
+package model
+
+import (
+	"time"
+
+	"github.com/team836/clowd-storage/pkg/database"
+)
+
+type NodeSession struct {
+	// column fields
+	ID             uint       `gorm:"type:int(11) unsigned auto_increment;primary_key"`
+	MachineID      string     `gorm:"type:varchar(255);not null;index"`
+	ConnectedAt    time.Time  `gorm:"type:datetime;not null;default:current_timestamp"`
+	DisconnectedAt *time.Time `gorm:"type:datetime"` // null while the node is connected
+}
+
+/**
+Migrate node session table.
+*/
+func MigrateNodeSession() {
+	database.
+		Conn().
+		Set("gorm:table_options", "CHARSET=utf8mb4").
+		AutoMigrate(&NodeSession{}).
+		Model(&NodeSession{}).
+		AddForeignKey("machine_id", "nodes(machine_id)", "CASCADE", "CASCADE")
+}
@@ -0,0 +1,55 @@
+package model
+
+type NodeState string
+
+const (
+	// connected and healthy
+	NodeOnline NodeState = "online"
+
+	// disconnected recently or failing the operations
+	NodeSuspect NodeState = "suspect"
+
+	// disconnected longer than the offline timeout
+	NodeOffline NodeState = "offline"
+
+	// disconnected longer than the lost timeout, so its shards are repaired
+	NodeLost NodeState = "lost"
+
+	// its shards are being migrated to the other nodes
+	NodeDraining NodeState = "draining"
+
+	// retired by the clowder after draining
+	NodeDecommissioned NodeState = "decommissioned"
+)
+
+/**
+Allowed previous states for each state.
+*/
+var nodeStateSources = map[NodeState][]NodeState{
+	NodeOnline:         {NodeSuspect, NodeOffline, NodeLost},
+	NodeSuspect:        {NodeOnline},
+	NodeOffline:        {NodeSuspect},
+	NodeLost:           {NodeOffline, NodeDraining},
+	NodeDraining:       {NodeOnline, NodeSuspect, NodeOffline},
+	NodeDecommissioned: {NodeDraining},
+}
+
+/**
+Return the states which can be transited to the given state.
+*/
+func (state NodeState) Sources() []NodeState {
+	return nodeStateSources[state]
+}
+
+/**
+Whether if the node in this state can be transited to the given state.
+*/
+func (state NodeState) CanTransit(to NodeState) bool {
+	for _, source := range to.Sources() {
+		if source == state {
+			return true
+		}
+	}
+
+	return false
+}
@@ -1,12 +1,34 @@
 package model
 
-import "github.com/team836/clowd-storage/pkg/database"
+import (
+	"time"
+
+	"github.com/team836/clowd-storage/pkg/database"
+)
 
 type Node struct {
 	// column fields
-	MachineID       string `gorm:"type:varchar(255);primary_key"`
-	MaxCapacity     uint16 `gorm:"type:smallint(4) unsigned;not null;default:1"`
-	ClowderGoogleID string `gorm:"type:varchar(63);not null"`
+	MachineID       string    `gorm:"type:varchar(255);primary_key"`
+	MaxCapacity     uint16    `gorm:"type:smallint(4) unsigned;not null;default:1"` // storage allocation declared by the clowder (GiB)
+	ClowderGoogleID string    `gorm:"type:varchar(63);not null"`
+	Zone            string    `gorm:"type:varchar(63);not null;default:''"` // failure zone declared by the clowder
+	LastSeenAt      time.Time `gorm:"type:datetime;not null;default:current_timestamp"`
+	State           NodeState `gorm:"type:varchar(15);not null;default:'online';index"`
+	StateChangedAt  time.Time `gorm:"type:datetime;not null;default:current_timestamp"`
+
+	// the max capacity is enforced only after the clowder declares it
+	CapacityDeclaredAt *time.Time `gorm:"type:datetime"`
+
+	// whether if the node reports more free space than it can have
+	CapacitySuspicious bool `gorm:"not null;default:false"`
+
+	// declared by the node at the handshake of the last connection
+	// The legacy node which does not send the hello has protocol version 0.
+	ProtocolVersion uint16     `gorm:"not null;default:0"`
+	SoftwareVersion string     `gorm:"type:varchar(63);not null;default:''"`
+	Features        string     `gorm:"type:varchar(255);not null;default:''"` // comma separated
+	DeclaredStorage uint64     `gorm:"not null;default:0"`                    // storage declared by the node (Byte)
+	HelloAt         *time.Time `gorm:"type:datetime"`
 
 	// associations fields
 	Shards []Shard `gorm:"foreignkey:MachineID;association_foreignkey:MachineID"` // node has many shards
@@ -23,3 +45,15 @@ func MigrateNode() {
 		Model(&Node{}).
 		AddForeignKey("clowder_google_id", "clowders(google_id)", "CASCADE", "CASCADE")
 }
+
+/**
+Return the storage allocation declared by the clowder in bytes.
+The second return value is false when the clowder has never declared it.
+*/
+func (node *Node) Allocation() (uint64, bool) {
+	if node.CapacityDeclaredAt == nil {
+		return 0, false
+	}
+
+	return uint64(node.MaxCapacity) << 30, true
+}
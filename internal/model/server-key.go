@@ -0,0 +1,25 @@
+package model
+
+import (
+	"time"
+
+	"github.com/team836/clowd-storage/pkg/database"
+)
+
+type ServerKey struct {
+	// column fields
+	ServerID    string    `gorm:"type:varchar(255);primary_key"` // host and port of the server
+	ActiveKeyID uint16    `gorm:"type:smallint(5) unsigned;not null"`
+	KeyIDs      string    `gorm:"type:varchar(255);not null"` // comma separated ids of the loaded master keys
+	SeenAt      time.Time `gorm:"type:datetime;not null;index"`
+}
+
+/**
+Migrate server key table.
+*/
+func MigrateServerKey() {
+	database.
+		Conn().
+		Set("gorm:table_options", "CHARSET=utf8mb4").
+		AutoMigrate(&ServerKey{})
+}
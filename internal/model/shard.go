@@ -4,10 +4,21 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"strconv"
+	"time"
 
 	"github.com/team836/clowd-storage/pkg/database"
 )
 
+type ShardState string
+
+const (
+	// placed on the node but not acknowledged yet
+	ShardPending ShardState = "pending"
+
+	// acknowledged by the node
+	ShardCommitted ShardState = "committed"
+)
+
 type ShardToSave struct {
 	Name string `json:"name"`
 	Data []byte `json:"data"`
@@ -16,6 +27,10 @@ type ShardToSave struct {
 type ShardToLoad struct {
 	Model *Shard
 	Data  []byte
+
+	// whether if the shard is missing or corrupted
+	// The shard which is not tried to load is not failed even though its data is nil.
+	Failed bool
 }
 
 type ShardToDelete struct {
@@ -29,6 +44,11 @@ type Shard struct {
 	FileID    uint   `gorm:"type:int(11) unsigned;not null;unique_index:shard_idx"`
 	MachineID string `gorm:"type:varchar(255);not null"`
 	Checksum  string `gorm:"type:char(64);not null"`
+	Size      uint   `gorm:"type:int(11) unsigned;not null;default:0"` // size of the shard data (Byte)
+
+	// the shard is committed only after the node acknowledges it
+	State     ShardState `gorm:"type:varchar(15);not null;default:'committed';index"`
+	UpdatedAt time.Time  `gorm:"type:datetime;not null;default:current_timestamp"`
 }
 
 /**
@@ -42,6 +62,26 @@ func MigrateShard() {
 		Model(&Shard{}).
 		AddForeignKey("file_id", "files(id)", "RESTRICT", "CASCADE").
 		AddForeignKey("machine_id", "nodes(machine_id)", "RESTRICT", "CASCADE")
+
+	backfillShardSize()
+}
+
+/**
+Fill the size of the shards which are saved before the size is recorded.
+The size is calculated from the file because every shards of the file have same size.
+*/
+func backfillShardSize() {
+	files := make([]*File, 0)
+	database.Conn().
+		Where("id IN (SELECT DISTINCT file_id FROM shards WHERE size = 0)").
+		Find(&files)
+
+	for _, file := range files {
+		database.Conn().
+			Model(&Shard{}).
+			Where("file_id = ? AND size = 0", file.ID).
+			UpdateColumn("size", file.ErasureProfile().ShardSize(file.StoredSize()))
+	}
 }
 
 /**
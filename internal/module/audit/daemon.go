@@ -0,0 +1,226 @@
+package audit
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/spf13/viper"
+	"github.com/team836/clowd-storage/internal/model"
+	"github.com/team836/clowd-storage/internal/module/reputation"
+	"github.com/team836/clowd-storage/internal/module/spool"
+	"github.com/team836/clowd-storage/pkg/database"
+	"github.com/team836/clowd-storage/pkg/logger"
+)
+
+const (
+	// time allowed to hand the challenge over to the node
+	challengeSendWait = 5 * time.Second
+
+	// time allowed to wait the answer from the node
+	answerWait = 15 * time.Second
+)
+
+var (
+	daemon *Daemon   // singleton instance
+	once   sync.Once // for thread safe singleton
+)
+
+/**
+Daemon which audits the shards on the active nodes in background.
+*/
+type Daemon struct {
+	// request the audit immediately
+	Trigger chan bool
+}
+
+/**
+Return the singleton audit daemon instance.
+*/
+func Service() *Daemon {
+	once.Do(func() {
+		daemon = newDaemon()
+	})
+
+	return daemon
+}
+
+/**
+Create new audit daemon.
+*/
+func newDaemon() *Daemon {
+	d := &Daemon{
+		Trigger: make(chan bool, 1), // buffered channel for non-blocking trigger
+	}
+
+	// run the audit periodically
+	go d.run()
+
+	return d
+}
+
+/**
+Run the audit at every interval or when triggered.
+*/
+func (d *Daemon) run() {
+	ticker := time.NewTicker(viper.GetDuration("AUDIT.INTERVAL"))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.Trigger:
+		}
+
+		d.audit()
+	}
+}
+
+/**
+Challenge every active nodes concurrently with a random shard on each node.
+*/
+func (d *Daemon) audit() {
+	var wg sync.WaitGroup
+	for _, node := range spool.Pool().Snapshot() {
+		// the node which cannot answer would be penalized unfairly
+		if !node.Supports(spool.FeatureAudit) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(node *spool.ActiveNode) {
+			defer wg.Done()
+
+			if err := auditNode(node); err != nil {
+				logger.File().Errorf("Error auditing the node(%s), %s", node.Model.MachineID, err)
+			}
+		}(node)
+	}
+
+	wg.Wait()
+}
+
+/**
+Send an unused challenge to the node and record the result.
+The challenge which is not answered stays unused, and no result is recorded,
+because the transport failure is not the proof of the missing shard.
+*/
+func auditNode(node *spool.ActiveNode) error {
+	challenge, err := pickChallenge(node.Model.MachineID)
+	if err != nil {
+		return err
+	}
+
+	// every challenges of the node are used
+	if challenge == nil {
+		return nil
+	}
+
+	answer := challengeNode(node, challenge)
+	if answer == nil {
+		logger.File().Infof("The node(%s) doesn't answer the audit of the shard(%s)", node.Model.MachineID, challenge.ShardName)
+		return nil
+	}
+
+	// each challenge is used only once for the node cannot replay the answer
+	if err := database.Conn().Model(challenge).Update("used", true).Error; err != nil {
+		return err
+	}
+
+	result := &model.AuditResult{
+		MachineID: node.Model.MachineID,
+		ShardName: challenge.ShardName,
+		Passed:    answer.Name == challenge.ShardName && answer.Hash == challenge.Expected,
+		CheckedAt: time.Now(),
+	}
+
+	if result.Passed {
+		reputation.Record(result.MachineID, reputation.AuditPassed)
+	} else {
+		logger.File().Warnf("The node(%s) failed the audit of the shard(%s)", result.MachineID, result.ShardName)
+		reputation.Record(result.MachineID, reputation.AuditFailed)
+	}
+
+	return database.Conn().Create(result).Error
+}
+
+/**
+Pick a random unused challenge for the committed shards on the node.
+The pending shards are not audited because the node may not have saved them.
+Return nil when there is no challenge left.
+
+The challenge is picked at a random id between the smallest and the largest id,
+so the challenges are not sorted randomly at every audit.
+*/
+func pickChallenge(machineID string) (*model.AuditChallenge, error) {
+	bounds := &struct {
+		MinID *uint
+		MaxID *uint
+	}{}
+	err := unusedChallenges(machineID).
+		Select("MIN(audit_challenges.id) AS min_id, MAX(audit_challenges.id) AS max_id").
+		Scan(bounds).
+		Error
+
+	if err != nil {
+		return nil, err
+	}
+
+	// every challenges of the node are used
+	if bounds.MinID == nil || bounds.MaxID == nil {
+		return nil, nil
+	}
+
+	pivot := *bounds.MinID + uint(rand.Int63n(int64(*bounds.MaxID-*bounds.MinID)+1))
+
+	challenge := &model.AuditChallenge{}
+	sqlResult := unusedChallenges(machineID).
+		Select("audit_challenges.*").
+		Where("audit_challenges.id >= ?", pivot).
+		Order("audit_challenges.id asc").
+		Limit(1).
+		Scan(challenge)
+
+	if sqlResult.RecordNotFound() {
+		return nil, nil
+	}
+
+	if sqlResult.Error != nil {
+		return nil, sqlResult.Error
+	}
+
+	return challenge, nil
+}
+
+/**
+Query the unused challenges of the committed shards on the node.
+*/
+func unusedChallenges(machineID string) *gorm.DB {
+	return database.Conn().
+		Table("audit_challenges").
+		Joins("JOIN shards ON shards.name = audit_challenges.shard_name").
+		Where("shards.machine_id = ? AND shards.state = ?", machineID, model.ShardCommitted).
+		Where("audit_challenges.used = ?", false)
+}
+
+/**
+Send the challenge to the node and wait the answer.
+Return nil when the node doesn't answer in time.
+*/
+func challengeNode(node *spool.ActiveNode, challenge *model.AuditChallenge) *spool.AuditAnswer {
+	answer := make(chan *spool.AuditAnswer, 1)
+
+	select {
+	case node.Audit <- &spool.AuditChan{ShardName: challenge.ShardName, Nonce: challenge.Nonce, Answer: answer}:
+	case <-time.After(challengeSendWait): // the node is busy or disconnected
+		return nil
+	}
+
+	select {
+	case received := <-answer:
+		return received
+	case <-time.After(answerWait):
+		return nil
+	}
+}
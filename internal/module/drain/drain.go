@@ -0,0 +1,390 @@
+package drain
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/team836/clowd-storage/internal/model"
+	"github.com/team836/clowd-storage/internal/module/lifecycle"
+	"github.com/team836/clowd-storage/internal/module/repair"
+	"github.com/team836/clowd-storage/internal/module/spool"
+	"github.com/team836/clowd-storage/pkg/database"
+	"github.com/team836/clowd-storage/pkg/errcorr"
+	"github.com/team836/clowd-storage/pkg/logger"
+)
+
+const (
+	// time allowed to load a batch of shards from the draining node
+	loadTimeout = 60 * time.Second
+)
+
+const (
+	Running  = "running"
+	Finished = "finished"
+	Aborted  = "aborted"
+)
+
+var (
+	ErrNodeNotActive   = errors.New("the node is not connected")
+	ErrCannotDrain     = errors.New("the node cannot be drained in current state")
+	ErrAlreadyDraining = errors.New("the node is already being drained")
+)
+
+var (
+	jobs     = make(map[string]*Progress) // progress of the drains by machine id
+	jobsLock sync.Mutex
+)
+
+/**
+Progress of the drain.
+*/
+type Progress struct {
+	State   string `json:"state"`
+	Total   int    `json:"total"`
+	Moved   int    `json:"moved"`
+	Pending int    `json:"pending"` // moved but not acknowledged by the new nodes yet
+	Failed  int    `json:"failed"`
+	Error   string `json:"error,omitempty"`
+}
+
+/**
+Start draining the node in background.
+
+  - Mark the node as draining so that no more shards are placed on it.
+  - Copy its shards to the other nodes directly from the node.
+  - Reconstruct the shards which cannot be copied from the other shards.
+  - Mark the node as decommissioned when it is empty
+    and every moved shards are acknowledged by the new nodes.
+*/
+func Start(machineID string) (*Progress, error) {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+
+	if job, ok := jobs[machineID]; ok && job.State == Running {
+		return nil, ErrAlreadyDraining
+	}
+
+	// the shards are copied from the node itself
+	node := spool.Pool().FindActiveNode(machineID)
+	if node == nil {
+		return nil, ErrNodeNotActive
+	}
+
+	// the node which is already draining can be restarted after the server restart
+	if node.State() != model.NodeDraining {
+		transited, err := lifecycle.Transit(machineID, model.NodeDraining)
+		if err != nil {
+			return nil, err
+		}
+
+		if !transited {
+			return nil, ErrCannotDrain
+		}
+	}
+
+	total, err := countShards(machineID)
+	if err != nil {
+		return nil, err
+	}
+
+	job := &Progress{State: Running, Total: total}
+	jobs[machineID] = job
+
+	go run(node, job)
+
+	return job.snapshot(), nil
+}
+
+/**
+Find the progress of the drain.
+If the drain is not started in this server, the progress is counted from the remaining shards.
+Return nil if the node is never drained.
+*/
+func Find(nodeModel *model.Node) (*Progress, error) {
+	if progress := findJob(nodeModel.MachineID); progress != nil {
+		return progress, nil
+	}
+
+	remaining, err := countShards(nodeModel.MachineID)
+	if err != nil {
+		return nil, err
+	}
+
+	pending, err := countPending(nodeModel.MachineID)
+	if err != nil {
+		return nil, err
+	}
+
+	progress := &Progress{State: Aborted, Total: remaining, Pending: pending}
+	switch nodeModel.State {
+	case model.NodeDecommissioned:
+		progress.State = Finished
+	case model.NodeDraining:
+	default:
+		return nil, nil
+	}
+
+	return progress, nil
+}
+
+/**
+Find the progress of the drain started in this server.
+*/
+func findJob(machineID string) *Progress {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+
+	if job, ok := jobs[machineID]; ok {
+		return job.snapshot()
+	}
+
+	return nil
+}
+
+/**
+Copy the progress for reading without the lock.
+SHOULD be called with the jobs lock.
+*/
+func (progress *Progress) snapshot() *Progress {
+	copied := *progress
+	return &copied
+}
+
+/**
+Update the progress with the jobs lock.
+*/
+func (progress *Progress) update(apply func(progress *Progress)) {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+
+	apply(progress)
+}
+
+/**
+Move every shards of the node batch by batch.
+*/
+func run(node *spool.ActiveNode, job *Progress) {
+	machineID := node.Model.MachineID
+	batchSize := viper.GetInt("DRAIN.BATCH_SIZE")
+	failedShards := make(map[string]bool)
+
+	for {
+		// the node is disconnected or transited by the lifecycle
+		if spool.Pool().FindActiveNode(machineID) != node || node.State() != model.NodeDraining {
+			abort(job, ErrNodeNotActive)
+			return
+		}
+
+		shards, err := findShards(machineID, failedShards, batchSize)
+		if err != nil {
+			abort(job, err)
+			return
+		}
+
+		// every shards which can be copied are moved
+		if len(shards) == 0 {
+			break
+		}
+
+		moved, unacked, failed := moveBatch(node, shards)
+		for _, shard := range failed {
+			failedShards[shard.Model.Name] = true
+		}
+
+		job.update(func(progress *Progress) {
+			progress.Moved += moved
+			progress.Pending += unacked
+			progress.Failed += len(failed)
+		})
+	}
+
+	// reconstruct the shards which cannot be copied from the node
+	for _, fileID := range filesOf(machineID, failedShards) {
+		shards, err := repair.Reconstruct(fileID, machineID)
+		var unacked []*model.ShardToSave
+		if err == nil {
+			unacked, err = repair.RestoreShards(shards)
+		}
+
+		if err != nil {
+			logger.File().Warnf("Cannot reconstruct the shards of the file(%d) on the draining node, %s", fileID, err)
+			continue
+		}
+
+		job.update(func(progress *Progress) {
+			progress.Moved += len(shards) - len(unacked)
+			progress.Pending += len(unacked)
+			progress.Failed -= len(shards)
+		})
+	}
+
+	remaining, err := countShards(machineID)
+	if err != nil {
+		abort(job, err)
+		return
+	}
+
+	if remaining != 0 {
+		abort(job, errors.New("some shards cannot be moved, try again later"))
+		return
+	}
+
+	// the node keeps its copies until the new nodes acknowledge them
+	pending, err := countPending(machineID)
+	if err != nil {
+		abort(job, err)
+		return
+	}
+
+	if pending != 0 {
+		abort(job, errors.New("some moved shards are not acknowledged yet, try again later"))
+		return
+	}
+
+	if _, err := lifecycle.Transit(machineID, model.NodeDecommissioned); err != nil {
+		abort(job, err)
+		return
+	}
+
+	job.update(func(progress *Progress) {
+		progress.State = Finished
+	})
+}
+
+/**
+Copy the shards from the draining node to the other nodes.
+Return the count of acknowledged and unacknowledged shards,
+and the shards which cannot be copied.
+*/
+func moveBatch(node *spool.ActiveNode, shards []*model.ShardToLoad) (int, int, []*model.ShardToLoad) {
+	ctx, cancel := context.WithTimeout(context.Background(), loadTimeout)
+	defer cancel()
+
+	done := make(chan *spool.LoadChan, 1)
+	loadChan := &spool.LoadChan{Ctx: ctx, Shards: shards, Done: done}
+
+	select {
+	case node.Load <- loadChan:
+		<-done
+	case <-ctx.Done():
+		return 0, 0, shards
+	}
+
+	// verify the copied data
+	loaded := make([]*model.ShardToLoad, 0, len(shards))
+	failed := make([]*model.ShardToLoad, 0)
+	for idx, shard := range shards {
+		if loadChan.Data == nil ||
+			len(loadChan.Data[idx]) == 0 ||
+			errcorr.IsCorruptedChecksum(loadChan.Data[idx], shard.Model.Checksum) {
+			failed = append(failed, shard)
+			continue
+		}
+
+		shard.Data = loadChan.Data[idx]
+		loaded = append(loaded, shard)
+	}
+
+	// the unacknowledged shards are already moved as pending, and they are repaired later
+	unacked, err := repair.RestoreShards(loaded)
+	if err != nil {
+		return 0, 0, shards
+	}
+
+	return len(loaded) - len(unacked), len(unacked), failed
+}
+
+/**
+Find the shards on the node except the failed ones.
+*/
+func findShards(machineID string, excluded map[string]bool, limit int) ([]*model.ShardToLoad, error) {
+	query := database.Conn().Where("machine_id = ?", machineID)
+
+	excludedNames := make([]string, 0, len(excluded))
+	for name := range excluded {
+		excludedNames = append(excludedNames, name)
+	}
+	if len(excludedNames) != 0 {
+		query = query.Where("name NOT IN (?)", excludedNames)
+	}
+
+	shardModels := make([]*model.Shard, 0)
+	sqlResult := query.Limit(limit).Find(&shardModels)
+	if sqlResult.Error != nil && !sqlResult.RecordNotFound() {
+		return nil, sqlResult.Error
+	}
+
+	shards := make([]*model.ShardToLoad, 0, len(shardModels))
+	for _, shardModel := range shardModels {
+		shards = append(shards, &model.ShardToLoad{Model: shardModel})
+	}
+
+	return shards, nil
+}
+
+/**
+Find the file ids of the shards on the node.
+*/
+func filesOf(machineID string, names map[string]bool) []uint {
+	if len(names) == 0 {
+		return nil
+	}
+
+	shardNames := make([]string, 0, len(names))
+	for name := range names {
+		shardNames = append(shardNames, name)
+	}
+
+	fileIDs := make([]uint, 0)
+	database.Conn().
+		Table("shards").
+		Where("machine_id = ? AND name IN (?)", machineID, shardNames).
+		Pluck("DISTINCT file_id", &fileIDs)
+
+	return fileIDs
+}
+
+/**
+Count the shards on the node.
+*/
+func countShards(machineID string) (int, error) {
+	count := 0
+	err := database.Conn().
+		Model(&model.Shard{}).
+		Where("machine_id = ?", machineID).
+		Count(&count).
+		Error
+
+	return count, err
+}
+
+/**
+Count the shards moved from the node which are not acknowledged by the new nodes yet.
+*/
+func countPending(machineID string) (int, error) {
+	count := 0
+	err := database.Conn().
+		Model(&model.Shard{}).
+		Joins("JOIN deleted_shards ON deleted_shards.name = shards.name").
+		Where("deleted_shards.machine_id = ? AND shards.state = ?", machineID, model.ShardPending).
+		Count(&count).
+		Error
+
+	return count, err
+}
+
+/**
+Stop the drain with the error.
+The node remains draining, so the drain can be started again.
+*/
+func abort(job *Progress, err error) {
+	logger.File().Warnf("The drain is aborted, %s", err)
+
+	job.update(func(progress *Progress) {
+		progress.State = Aborted
+		progress.Error = err.Error()
+	})
+}
@@ -0,0 +1,93 @@
+package keyrotation
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/team836/clowd-storage/internal/model"
+	"github.com/team836/clowd-storage/pkg/database"
+	"github.com/team836/clowd-storage/pkg/encrypt"
+	"github.com/team836/clowd-storage/pkg/logger"
+)
+
+const (
+	// count of the missed reports after which the server is regarded as stopped
+	missedReports = 3
+)
+
+var (
+	ErrNotDeployed = errors.New("the active master key is not deployed to every running server")
+)
+
+/**
+Report the master keys loaded in this server periodically,
+so the rotation can verify that every running server has the active master key.
+*/
+func Report(serverID string) {
+	keyRing, err := encrypt.Keys()
+	if err != nil {
+		logger.File().Errorf("Error reporting the master keys, %s", err)
+		return
+	}
+
+	activeID, _ := keyRing.Active()
+	ids := make([]string, 0)
+	for _, id := range keyRing.IDs() {
+		ids = append(ids, strconv.Itoa(int(id)))
+	}
+
+	serverKey := &model.ServerKey{
+		ServerID:    serverID,
+		ActiveKeyID: activeID,
+		KeyIDs:      strings.Join(ids, ","),
+	}
+
+	go func() {
+		ticker := time.NewTicker(viper.GetDuration("ENCRYPTION.REPORT_INTERVAL"))
+		defer ticker.Stop()
+
+		for {
+			serverKey.SeenAt = time.Now()
+			if err := database.Conn().Save(serverKey).Error; err != nil {
+				logger.File().Errorf("Error reporting the master keys, %s", err)
+			}
+
+			<-ticker.C
+		}
+	}()
+}
+
+/**
+Verify that every running server wraps new data keys with the active master key.
+Otherwise the files uploaded to the outdated servers are wrapped by the old master key,
+and the servers cannot decrypt the re-wrapped files.
+*/
+func CheckDeployment() error {
+	keyRing, err := encrypt.Keys()
+	if err != nil {
+		return err
+	}
+
+	activeID, _ := keyRing.Active()
+	seenSince := time.Now().Add(-missedReports * viper.GetDuration("ENCRYPTION.REPORT_INTERVAL"))
+
+	outdated := make([]string, 0)
+	sqlResult := database.Conn().
+		Model(&model.ServerKey{}).
+		Where("seen_at > ? AND active_key_id <> ?", seenSince, activeID).
+		Pluck("server_id", &outdated)
+
+	if sqlResult.Error != nil {
+		return sqlResult.Error
+	}
+
+	if len(outdated) != 0 {
+		return fmt.Errorf("%w, restart %s", ErrNotDeployed, strings.Join(outdated, ", "))
+	}
+
+	return nil
+}
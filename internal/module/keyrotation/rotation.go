@@ -0,0 +1,146 @@
+package keyrotation
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/team836/clowd-storage/internal/model"
+	"github.com/team836/clowd-storage/pkg/database"
+	"github.com/team836/clowd-storage/pkg/encrypt"
+	"github.com/team836/clowd-storage/pkg/logger"
+)
+
+/**
+Progress of the key rotation.
+*/
+type Progress struct {
+	// count of files whose data key is re-wrapped
+	Done int
+
+	// count of files whose data key cannot be re-wrapped
+	Failed int
+
+	// count of files which need re-wrapping when the rotation started
+	Total int
+}
+
+/**
+Re-wrap every data key which is wrapped by the old master keys with the active master key.
+
+Files are processed in batches ordered by id, and each batch is committed at once.
+The rotated files are not selected again,
+so the interrupted rotation can be resumed by just running it again.
+*/
+func Rotate(batchSize int, report func(*Progress)) (*Progress, error) {
+	keyRing, err := encrypt.Keys()
+	if err != nil {
+		return nil, err
+	}
+
+	activeID, activeKey := keyRing.Active()
+	progress := &Progress{}
+
+	// count the files to rotate
+	sqlResult := staleFiles(activeID).
+		Model(&model.File{}).
+		Count(&progress.Total)
+
+	if sqlResult.Error != nil {
+		return nil, sqlResult.Error
+	}
+
+	var lastID uint
+	for {
+		files := make([]*model.File, 0)
+		sqlResult := staleFiles(activeID).
+			Select("id, key_id, wrapped_key").
+			Where("id > ?", lastID).
+			Order("id asc").
+			Limit(batchSize).
+			Find(&files)
+
+		if sqlResult.Error != nil && !sqlResult.RecordNotFound() {
+			return progress, sqlResult.Error
+		}
+
+		// every file is rotated
+		if len(files) == 0 {
+			break
+		}
+
+		if err := rotateBatch(files, keyRing, activeID, activeKey, progress); err != nil {
+			return progress, err
+		}
+
+		lastID = files[len(files)-1].ID
+		report(progress)
+	}
+
+	return progress, nil
+}
+
+/**
+Re-wrap the data keys of the files in one transaction.
+*/
+func rotateBatch(
+	files []*model.File,
+	keyRing *encrypt.KeyRing,
+	activeID uint16,
+	activeKey []byte,
+	progress *Progress,
+) error {
+	// begin a transaction
+	tx := database.Conn().Begin()
+	if err := tx.Error; err != nil {
+		return err
+	}
+
+	done := 0
+	for _, file := range files {
+		oldKey, err := keyRing.Find(file.KeyID)
+		if err != nil {
+			logger.Console().Warnf("Cannot find the master key(%d) of the file(%d)", file.KeyID, file.ID)
+			progress.Failed++
+			continue
+		}
+
+		wrappedKey, err := encrypt.RewrapKey(
+			file.WrappedKey,
+			oldKey,
+			file.KeyAAD(file.KeyID),
+			activeKey,
+			file.KeyAAD(activeID),
+		)
+		if err != nil {
+			logger.Console().Warnf("Cannot re-wrap the data key of the file(%d), %s", file.ID, err)
+			progress.Failed++
+			continue
+		}
+
+		err = tx.Model(file).
+			UpdateColumns(map[string]interface{}{"wrapped_key": wrappedKey, "key_id": activeID}).
+			Error
+
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		done++
+	}
+
+	// commit the transaction
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	progress.Done += done
+
+	return nil
+}
+
+/**
+Query the encrypted files whose data key is not wrapped by the active master key.
+*/
+func staleFiles(activeID uint16) *gorm.DB {
+	return database.Conn().
+		Where("wrapped_key IS NOT NULL AND wrapped_key <> '' AND key_id <> ?", activeID)
+}
@@ -0,0 +1,103 @@
+package lifecycle
+
+import (
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/team836/clowd-storage/internal/model"
+	"github.com/team836/clowd-storage/pkg/database"
+	"github.com/team836/clowd-storage/pkg/logger"
+)
+
+var (
+	daemon *Daemon   // singleton instance
+	once   sync.Once // for thread safe singleton
+)
+
+/**
+Daemon which advances the states of the disconnected nodes by the timeouts.
+
+- online: not connected → suspect (e.g. after the server restart)
+- suspect: disconnected longer than the offline timeout → offline
+- offline: disconnected longer than the lost timeout → lost
+- draining: disconnected longer than the lost timeout → lost
+*/
+type Daemon struct {
+	// whether if the node is connected currently
+	IsConnected func(machineID string) bool
+}
+
+/**
+Return the singleton lifecycle daemon instance.
+*/
+func Service(isConnected func(machineID string) bool) *Daemon {
+	once.Do(func() {
+		daemon = newDaemon(isConnected)
+	})
+
+	return daemon
+}
+
+/**
+Create new lifecycle daemon.
+*/
+func newDaemon(isConnected func(machineID string) bool) *Daemon {
+	d := &Daemon{IsConnected: isConnected}
+
+	// advance the states periodically
+	go d.run()
+
+	return d
+}
+
+/**
+Advance the states at every interval.
+*/
+func (d *Daemon) run() {
+	ticker := time.NewTicker(viper.GetDuration("NODE_STATE.CHECK_INTERVAL"))
+	defer ticker.Stop()
+
+	for range ticker.C {
+		d.advance()
+	}
+}
+
+/**
+Advance the states of the disconnected nodes.
+*/
+func (d *Daemon) advance() {
+	now := time.Now()
+
+	// the timeouts are measured from the last seen time which is the disconnected time
+	d.advanceState(model.NodeOnline, model.NodeSuspect, now)
+	d.advanceState(model.NodeSuspect, model.NodeOffline, now.Add(-viper.GetDuration("NODE_STATE.OFFLINE_AFTER")))
+	d.advanceState(model.NodeOffline, model.NodeLost, now.Add(-viper.GetDuration("NODE_STATE.LOST_AFTER")))
+	d.advanceState(model.NodeDraining, model.NodeLost, now.Add(-viper.GetDuration("NODE_STATE.LOST_AFTER")))
+}
+
+/**
+Transit the disconnected nodes in the state which are not seen since the deadline.
+*/
+func (d *Daemon) advanceState(from, to model.NodeState, deadline time.Time) {
+	nodes := make([]*model.Node, 0)
+	sqlResult := database.Conn().
+		Where("state = ? AND last_seen_at <= ?", from, deadline).
+		Find(&nodes)
+
+	if sqlResult.Error != nil && !sqlResult.RecordNotFound() {
+		logger.File().Errorf("Error finding the %s nodes, %s", from, sqlResult.Error)
+		return
+	}
+
+	for _, node := range nodes {
+		// the connected node is suspected by its failures, not timeouts
+		if d.IsConnected(node.MachineID) {
+			continue
+		}
+
+		if _, err := Transit(node.MachineID, to); err != nil {
+			logger.File().Errorf("Error transiting the node(%s) to %s, %s", node.MachineID, to, err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package lifecycle
+
+import (
+	"sync"
+	"time"
+
+	"github.com/team836/clowd-storage/internal/model"
+	"github.com/team836/clowd-storage/pkg/database"
+)
+
+/**
+Listener which is called after the state of the node is changed.
+*/
+type Listener func(machineID string, from, to model.NodeState)
+
+var (
+	listeners     []Listener
+	listenersLock sync.RWMutex
+)
+
+/**
+Register the listener for every state transitions.
+*/
+func Subscribe(listener Listener) {
+	listenersLock.Lock()
+	defer listenersLock.Unlock()
+
+	listeners = append(listeners, listener)
+}
+
+/**
+Transit the state of the node if it is allowed from the current state.
+Return whether if the state is changed.
+
+The transition is compare-and-swap on the database,
+so the concurrent transitions of the same node are serialized.
+*/
+func Transit(machineID string, to model.NodeState) (bool, error) {
+	node := &model.Node{}
+	if err := database.Conn().Where("machine_id = ?", machineID).First(node).Error; err != nil {
+		return false, err
+	}
+
+	from := node.State
+	if !from.CanTransit(to) {
+		return false, nil
+	}
+
+	sqlResult := database.Conn().
+		Model(&model.Node{}).
+		Where("machine_id = ? AND state = ?", machineID, from).
+		Updates(map[string]interface{}{"state": to, "state_changed_at": time.Now()})
+
+	if sqlResult.Error != nil {
+		return false, sqlResult.Error
+	}
+
+	// the state is changed by another transition meanwhile
+	if sqlResult.RowsAffected == 0 {
+		return false, nil
+	}
+
+	notify(machineID, from, to)
+
+	return true, nil
+}
+
+/**
+Call every listeners for the transition.
+*/
+func notify(machineID string, from, to model.NodeState) {
+	listenersLock.RLock()
+	defer listenersLock.RUnlock()
+
+	for _, listener := range listeners {
+		listener(machineID, from, to)
+	}
+}
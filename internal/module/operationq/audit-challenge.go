@@ -0,0 +1,65 @@
+package operationq
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/spf13/viper"
+	"github.com/team836/clowd-storage/internal/model"
+)
+
+/**
+Create the audit challenges of the shards which have no unused challenge,
+e.g. the shards stored before the audit or whose challenges are used up.
+
+The expected answers are computed from the shard data,
+so the data SHOULD be verified by the server, e.g. reconstructed or decrypted,
+not just supplied by the node which is audited later.
+*/
+func PrepareChallenges(tx *gorm.DB, shards []*model.ShardToLoad) error {
+	names := make([]string, 0, len(shards))
+	for _, shard := range shards {
+		if shard.Data != nil {
+			names = append(names, shard.Model.Name)
+		}
+	}
+
+	if len(names) == 0 {
+		return nil
+	}
+
+	// the shards which still have unused challenges
+	challengedNames := make([]string, 0)
+	err := tx.
+		Model(&model.AuditChallenge{}).
+		Where("shard_name IN (?) AND used = ?", names, false).
+		Pluck("DISTINCT shard_name", &challengedNames).
+		Error
+
+	if err != nil {
+		return err
+	}
+
+	challenged := make(map[string]bool, len(challengedNames))
+	for _, name := range challengedNames {
+		challenged[name] = true
+	}
+
+	challengeCount := viper.GetInt("AUDIT.CHALLENGES_PER_SHARD")
+	for _, shard := range shards {
+		if shard.Data == nil || challenged[shard.Model.Name] {
+			continue
+		}
+
+		challenges, err := model.NewAuditChallenges(shard.Model.Name, shard.Data, challengeCount)
+		if err != nil {
+			return err
+		}
+
+		for _, challenge := range challenges {
+			if err := tx.Create(challenge).Error; err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
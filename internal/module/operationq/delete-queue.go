@@ -43,6 +43,31 @@ func (delQ *DeleteQueue) Push(googleID string, fileNames ...string) error {
 	return nil
 }
 
+/**
+Push the file records to delete.
+*/
+func (delQ *DeleteQueue) PushFiles(files ...*model.File) error {
+	ids := make([]uint, 0, len(files))
+	for _, file := range files {
+		ids = append(ids, file.ID)
+	}
+
+	found := make([]*model.File, 0)
+	sqlResult := database.Conn().
+		Where("id IN (?)", ids).
+		Preload("Shards").
+		Find(&found)
+
+	if sqlResult.Error != nil && !sqlResult.RecordNotFound() {
+		logger.File().Errorf("Error finding the file in database, %s", sqlResult.Error.Error())
+		return sqlResult.Error
+	}
+
+	delQ.Files = append(delQ.Files, found...)
+
+	return nil
+}
+
 /**
 Assign shards for deletion to the each nodes
 which are identified by machine id.
@@ -1,7 +1,18 @@
 package operationq
 
 import (
+	"context"
 	"errors"
+	"sort"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/jinzhu/gorm"
+
+	"github.com/team836/clowd-storage/internal/module/reputation"
+	"github.com/team836/clowd-storage/internal/module/spool"
+	"github.com/team836/clowd-storage/pkg/errcorr"
 
 	"github.com/team836/clowd-storage/internal/model"
 	"github.com/team836/clowd-storage/pkg/database"
@@ -45,35 +56,63 @@ func (dq *DownloadQueue) Push(googleID string, fileName string) error {
 
 	// for every file records(segments)
 	for _, fileModel := range fileModels {
-		fileToLoad := &model.FileToLoad{Model: fileModel}
-
-		// find all shards of the segment which are ordered by its position
-		shardModels := &[]*model.Shard{}
-		sqlResult := database.Conn().
-			Where("file_id = ?", fileModel.ID).
-			Order("position asc").
-			Find(shardModels)
-
-		if sqlResult.Error != nil {
-			// if the shard which is corresponding to the file is not exist in the record
-			if sqlResult.RecordNotFound() {
-				return ErrFileNotExist
-			}
-
-			// other sql error
-			logger.File().Errorf("Error finding the shard in database, %s", sqlResult.Error.Error())
-			return sqlResult.Error
+		if err := dq.PushSegment(fileModel); err != nil {
+			return err
 		}
+	}
+
+	return nil
+}
+
+/**
+Push the segment of the file to load with its all shards.
+*/
+func (dq *DownloadQueue) PushSegment(fileModel *model.File) error {
+	return dq.pushShards(fileModel, database.Conn().Where("file_id = ?", fileModel.ID))
+}
+
+/**
+Push the segment of the file to load with only the shards
+whose position is between `from` and `to`(inclusive).
+*/
+func (dq *DownloadQueue) PushSegmentShards(fileModel *model.File, from, to int) error {
+	return dq.pushShards(
+		fileModel,
+		database.Conn().Where("file_id = ? AND position BETWEEN ? AND ?", fileModel.ID, from, to),
+	)
+}
+
+/**
+Push the segment of the file to load with the shards found by the query.
+*/
+func (dq *DownloadQueue) pushShards(fileModel *model.File, query *gorm.DB) error {
+	fileToLoad := &model.FileToLoad{Model: fileModel}
+
+	// find the shards of the segment which are ordered by its position
+	shardModels := &[]*model.Shard{}
+	sqlResult := query.
+		Order("position asc").
+		Find(shardModels)
 
-		// for every shards
-		for _, shardModel := range *shardModels {
-			shardToLoad := &model.ShardToLoad{Model: shardModel}
-			fileToLoad.Shards = append(fileToLoad.Shards, shardToLoad)
+	if sqlResult.Error != nil {
+		// if the shard which is corresponding to the file is not exist in the record
+		if sqlResult.RecordNotFound() {
+			return ErrFileNotExist
 		}
 
-		dq.Files = append(dq.Files, fileToLoad)
+		// other sql error
+		logger.File().Errorf("Error finding the shard in database, %s", sqlResult.Error.Error())
+		return sqlResult.Error
+	}
+
+	// for every shards
+	for _, shardModel := range *shardModels {
+		shardToLoad := &model.ShardToLoad{Model: shardModel}
+		fileToLoad.Shards = append(fileToLoad.Shards, shardToLoad)
 	}
 
+	dq.Files = append(dq.Files, fileToLoad)
+
 	return nil
 }
 
@@ -97,3 +136,326 @@ func (dq *DownloadQueue) Schedule() map[string][]*model.ShardToLoad {
 
 	return quotas
 }
+
+/**
+Download the shards from the active nodes and wait until each file has enough valid shards.
+
+Reed-Solomon needs only the count of data shards to decode the file.
+So, request the data shards first and a few extra shards from the nodes with low latency,
+and stop waiting as soon as every file has enough valid shards.
+If the requested shards turn out to be not enough, request the rest of the shards.
+
+When every data shards of the file are on the active nodes and the data shards are preferred,
+the extra shards are requested only if the file is not satisfied within the hedge delay.
+So the parity shards are not transferred in the common case, but the slow nodes are still hedged.
+
+The shards which are missing or corrupted are marked as failed and remain nil data.
+The shards which are not requested also remain nil data, but not failed.
+*/
+func (dq *DownloadQueue) Load(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, viper.GetDuration("DOWNLOAD.TIMEOUT"))
+	defer cancel() // cancel the remaining loadings
+
+	loads := make([]*fileLoad, 0, len(dq.Files))
+	for _, file := range dq.Files {
+		loads = append(loads, newFileLoad(file, viper.GetInt("DOWNLOAD.EXTRA_SHARDS")))
+	}
+
+	// enough for all loadings not to block the nodes
+	shardCount := 0
+	for _, file := range dq.Files {
+		shardCount += len(file.Shards)
+	}
+	done := make(chan *spool.LoadChan, shardCount)
+
+	dispatch := func(shards []*model.ShardToLoad) int {
+		return dispatchLoads(ctx, shards, done)
+	}
+
+	// request the first shards of every files
+	pending := requestLoads(loads, (*fileLoad).first, dispatch)
+
+	hedge := time.NewTimer(viper.GetDuration("DOWNLOAD.HEDGE_DELAY"))
+	defer hedge.Stop()
+
+	for pending > 0 && !allSatisfied(loads) {
+		select {
+		case <-hedge.C:
+			// the data shards are slow, so request the extra shards which are held back
+			pending += requestLoads(loads, (*fileLoad).hedge, dispatch)
+		case loadChan := <-done:
+			pending--
+			applyLoad(loadChan)
+
+			// request more shards for the files which cannot be satisfied by pending shards
+			pending += requestLoads(loads, (*fileLoad).refill, dispatch)
+		case <-ctx.Done():
+			logger.File().Infof("Loading the shards is timed out or canceled")
+			return
+		}
+	}
+}
+
+/**
+Loading state of the file.
+*/
+type fileLoad struct {
+	file *model.FileToLoad
+
+	// erasure profile of the file
+	profile *errcorr.Profile
+
+	// count of shards which are needed to decode
+	needed int
+
+	// count of shards to request more than needed
+	extra int
+
+	// count of extra shards which are held back until the hedge delay
+	deferred int
+
+	// shards which are not requested yet, ordered by priority
+	candidates []*model.ShardToLoad
+}
+
+func newFileLoad(file *model.FileToLoad, extra int) *fileLoad {
+	load := &fileLoad{file: file, profile: file.Model.ErasureProfile(), extra: extra}
+
+	// only the active nodes can be requested
+	latencies := make(map[*model.ShardToLoad]time.Duration)
+	suspected := make([]*model.ShardToLoad, 0)
+	for _, shard := range file.Shards {
+		shard.Data = nil
+		shard.Failed = false
+
+		activeNode := spool.Pool().FindActiveNode(shard.Model.MachineID)
+		if activeNode == nil {
+			shard.Failed = true
+			continue
+		}
+
+		// the suspect nodes are skipped unless the other nodes fail
+		if activeNode.State() == model.NodeSuspect {
+			suspected = append(suspected, shard)
+			continue
+		}
+
+		latencies[shard] = activeNode.Latency()
+		load.candidates = append(load.candidates, shard)
+	}
+
+	// the data shard is requested first because it can be joined without reconstruction,
+	// and the shard on the node with lower latency is requested first
+	sort.SliceStable(load.candidates, func(i, j int) bool {
+		iData := load.isDataShard(load.candidates[i])
+		if iData != load.isDataShard(load.candidates[j]) {
+			return iData
+		}
+
+		return latencies[load.candidates[i]] < latencies[load.candidates[j]]
+	})
+
+	// when every data shards can be requested, hold back the extra parity shards
+	// so the parity shards are used only for the failures and the slow nodes
+	if viper.GetBool("DOWNLOAD.PREFER_DATA_SHARDS") && load.countDataShards(load.candidates) == load.profile.DataShards {
+		load.deferred, load.extra = load.extra, 0
+	}
+
+	// the shards on the suspect nodes are requested last
+	load.candidates = append(load.candidates, suspected...)
+
+	// need all shards if some of the shards are pushed
+	load.needed = load.profile.DataShards
+	if len(file.Shards) < load.needed {
+		load.needed = len(file.Shards)
+	}
+
+	return load
+}
+
+/**
+Check whether if the shard is data shard, not parity shard.
+*/
+func (load *fileLoad) isDataShard(shard *model.ShardToLoad) bool {
+	return int(shard.Model.Position) < load.profile.DataShards
+}
+
+/**
+Count the data shards among the shards.
+*/
+func (load *fileLoad) countDataShards(shards []*model.ShardToLoad) int {
+	count := 0
+	for _, shard := range shards {
+		if load.isDataShard(shard) {
+			count++
+		}
+	}
+
+	return count
+}
+
+/**
+Count the valid shards and the requested shards which are not finished yet.
+*/
+func (load *fileLoad) count() (valid int, inflight int) {
+	failed := 0
+	for _, shard := range load.file.Shards {
+		if shard.Data != nil {
+			valid++
+		} else if shard.Failed {
+			failed++
+		}
+	}
+
+	return valid, len(load.file.Shards) - valid - failed - len(load.candidates)
+}
+
+/**
+Take the shards to request at first, which are the needed shards with extra ones.
+*/
+func (load *fileLoad) first() []*model.ShardToLoad {
+	return load.take(load.needed + load.extra)
+}
+
+/**
+Take the extra shards which are held back, if the file is not satisfied yet.
+*/
+func (load *fileLoad) hedge() []*model.ShardToLoad {
+	count := load.deferred
+	load.deferred = 0
+
+	if valid, _ := load.count(); valid >= load.needed {
+		return nil
+	}
+
+	return load.take(count)
+}
+
+/**
+Take the shards to request more
+when the valid shards and the pending shards are not enough because of failures.
+*/
+func (load *fileLoad) refill() []*model.ShardToLoad {
+	valid, inflight := load.count()
+	return load.take(load.needed - valid - inflight)
+}
+
+/**
+Take the candidates as many as the count.
+*/
+func (load *fileLoad) take(count int) []*model.ShardToLoad {
+	if count <= 0 {
+		return nil
+	}
+
+	if count > len(load.candidates) {
+		count = len(load.candidates)
+	}
+
+	shards := load.candidates[:count]
+	load.candidates = load.candidates[count:]
+
+	return shards
+}
+
+/**
+Request the shards which are taken from every files, and return the count of requests.
+
+The shards on the disconnected nodes are failed without the request,
+so the other candidates are refilled for them
+until some shards are requested or no candidate is left.
+*/
+func requestLoads(
+	loads []*fileLoad,
+	take func(load *fileLoad) []*model.ShardToLoad,
+	dispatch func(shards []*model.ShardToLoad) int,
+) int {
+	for {
+		requests := make([]*model.ShardToLoad, 0)
+		for _, load := range loads {
+			requests = append(requests, take(load)...)
+		}
+
+		if len(requests) == 0 {
+			return 0
+		}
+
+		if count := dispatch(requests); count != 0 {
+			return count
+		}
+
+		take = (*fileLoad).refill
+	}
+}
+
+/**
+Check whether if every files have enough valid shards.
+*/
+func allSatisfied(loads []*fileLoad) bool {
+	for _, load := range loads {
+		if valid, _ := load.count(); valid < load.needed {
+			return false
+		}
+	}
+
+	return true
+}
+
+/**
+Send the loading requests to each nodes and return the count of requests.
+*/
+func dispatchLoads(ctx context.Context, shards []*model.ShardToLoad, done chan *spool.LoadChan) int {
+	// group the shards by the node
+	quotas := make(map[string][]*model.ShardToLoad)
+	for _, shard := range shards {
+		quotas[shard.Model.MachineID] = append(quotas[shard.Model.MachineID], shard)
+	}
+
+	count := 0
+	for machineID, quota := range quotas {
+		activeNode := spool.Pool().FindActiveNode(machineID)
+
+		// the node is disconnected after scheduling
+		if activeNode == nil {
+			for _, shard := range quota {
+				shard.Failed = true
+			}
+			continue
+		}
+
+		loadChan := &spool.LoadChan{Ctx: ctx, Shards: quota, Done: done}
+		count++
+
+		// start new worker for download
+		go func(a *spool.ActiveNode, l *spool.LoadChan) {
+			select {
+			case a.Load <- l:
+			case <-l.Ctx.Done():
+				l.Done <- l
+			}
+		}(activeNode, loadChan)
+	}
+
+	return count
+}
+
+/**
+Apply the loaded data to the shards.
+If shard is missing or corrupted, mark it as failed.
+*/
+func applyLoad(loadChan *spool.LoadChan) {
+	for idx, shard := range loadChan.Shards {
+		if loadChan.Data == nil || len(loadChan.Data[idx]) == 0 {
+			shard.Failed = true
+			continue
+		}
+
+		if errcorr.IsCorruptedChecksum(loadChan.Data[idx], shard.Model.Checksum) {
+			go reputation.Record(shard.Model.MachineID, reputation.ChecksumMismatch)
+			shard.Failed = true
+			continue
+		}
+
+		shard.Data = loadChan.Data[idx]
+	}
+}
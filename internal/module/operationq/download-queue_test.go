@@ -0,0 +1,175 @@
+package operationq
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/team836/clowd-storage/internal/model"
+)
+
+/**
+Make the loading state of the file whose shards are on the nodes in order.
+*/
+func newTestLoad(machineIDs []string, dataShards, parityShards uint8, extra int) *fileLoad {
+	file := &model.FileToLoad{Model: &model.File{DataShards: dataShards, ParityShards: parityShards}}
+	for idx, machineID := range machineIDs {
+		file.Shards = append(file.Shards, &model.ShardToLoad{
+			Model: &model.Shard{Name: machineID, Position: uint8(idx), MachineID: machineID},
+		})
+	}
+
+	load := &fileLoad{file: file, profile: file.Model.ErasureProfile(), extra: extra}
+	load.candidates = append(load.candidates, file.Shards...)
+	load.needed = load.profile.DataShards
+
+	return load
+}
+
+func TestRequestLoads(t *testing.T) {
+	tests := []struct {
+		name           string
+		machineIDs     []string
+		extra          int
+		disconnected   []string
+		wantCount      int
+		wantRequested  []string
+		wantFailed     []string
+		wantCandidates int
+	}{
+		{
+			name:           "every first nodes are connected",
+			machineIDs:     []string{"a", "b", "c", "d"},
+			wantCount:      2,
+			wantRequested:  []string{"a", "b"},
+			wantCandidates: 2,
+		},
+		{
+			name:           "every first nodes are disconnected",
+			machineIDs:     []string{"a", "b", "c", "d"},
+			disconnected:   []string{"a", "b"},
+			wantCount:      2,
+			wantRequested:  []string{"c", "d"},
+			wantFailed:     []string{"a", "b"},
+			wantCandidates: 0,
+		},
+		{
+			name:           "refilled nodes are disconnected too",
+			machineIDs:     []string{"a", "b", "c", "d", "e", "f"},
+			disconnected:   []string{"a", "b", "c", "d"},
+			wantCount:      2,
+			wantRequested:  []string{"e", "f"},
+			wantFailed:     []string{"a", "b", "c", "d"},
+			wantCandidates: 0,
+		},
+		{
+			name:           "extra shards are on the disconnected nodes",
+			machineIDs:     []string{"a", "b", "c", "d"},
+			extra:          1,
+			disconnected:   []string{"a", "b", "c"},
+			wantCount:      1,
+			wantRequested:  []string{"d"},
+			wantFailed:     []string{"a", "b", "c"},
+			wantCandidates: 0,
+		},
+		{
+			name:           "every nodes are disconnected",
+			machineIDs:     []string{"a", "b", "c"},
+			disconnected:   []string{"a", "b", "c"},
+			wantCount:      0,
+			wantFailed:     []string{"a", "b", "c"},
+			wantCandidates: 0,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			load := newTestLoad(test.machineIDs, 2, uint8(len(test.machineIDs)-2), test.extra)
+
+			disconnected := make(map[string]bool)
+			for _, machineID := range test.disconnected {
+				disconnected[machineID] = true
+			}
+
+			// request each shard to its node unless the node is disconnected
+			requested := make([]string, 0)
+			dispatch := func(shards []*model.ShardToLoad) int {
+				count := 0
+				for _, shard := range shards {
+					if disconnected[shard.Model.MachineID] {
+						shard.Failed = true
+						continue
+					}
+
+					requested = append(requested, shard.Model.Name)
+					count++
+				}
+
+				return count
+			}
+
+			count := requestLoads([]*fileLoad{load}, (*fileLoad).first, dispatch)
+			if count != test.wantCount {
+				t.Errorf("requestLoads() = %d, want %d", count, test.wantCount)
+			}
+
+			failed := make([]string, 0)
+			for _, shard := range load.file.Shards {
+				if shard.Failed {
+					failed = append(failed, shard.Model.Name)
+				}
+			}
+			sort.Strings(requested)
+			sort.Strings(failed)
+
+			if want := append([]string{}, test.wantRequested...); !reflect.DeepEqual(requested, want) {
+				t.Errorf("requested = %v, want %v", requested, want)
+			}
+
+			if want := append([]string{}, test.wantFailed...); !reflect.DeepEqual(failed, want) {
+				t.Errorf("failed = %v, want %v", failed, want)
+			}
+
+			if len(load.candidates) != test.wantCandidates {
+				t.Errorf("candidates = %d, want %d", len(load.candidates), test.wantCandidates)
+			}
+		})
+	}
+}
+
+func TestHedge(t *testing.T) {
+	tests := []struct {
+		name     string
+		deferred int
+		valid    int // count of the first shards which are loaded
+		want     int
+	}{
+		{"slow data shards", 2, 0, 2},
+		{"one slow data shard", 2, 1, 2},
+		{"satisfied", 2, 2, 0},
+		{"nothing held back", 0, 0, 0},
+		{"more than candidates", 5, 0, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			load := newTestLoad([]string{"a", "b", "c", "d"}, 2, 2, 0)
+			load.deferred = test.deferred
+
+			for _, shard := range load.first() {
+				if test.valid > 0 {
+					shard.Data = []byte("data")
+					test.valid--
+				}
+			}
+
+			if got := load.hedge(); len(got) != test.want {
+				t.Errorf("hedge() = %d shards, want %d", len(got), test.want)
+			}
+
+			if load.deferred != 0 {
+				t.Errorf("deferred = %d after the hedge, want 0", load.deferred)
+			}
+		})
+	}
+}
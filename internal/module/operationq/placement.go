@@ -0,0 +1,201 @@
+package operationq
+
+import (
+	"container/ring"
+	"errors"
+
+	"github.com/jinzhu/gorm"
+	"github.com/spf13/viper"
+	"github.com/team836/clowd-storage/internal/model"
+	"github.com/team836/clowd-storage/internal/module/spool"
+)
+
+var (
+	ErrLackOfFailureDomains = errors.New("cannot spread the shards over enough nodes, clowders or zones")
+)
+
+/**
+Cursor walking the safe ring first and the unsafe ring next.
+Each ring moves forward whenever a node is visited,
+so the shards are distributed in round robin order.
+*/
+type ringCursor struct {
+	safe   *ring.Ring
+	unsafe *ring.Ring
+}
+
+func newRingCursor(safeRing, unsafeRing *ring.Ring) *ringCursor {
+	return &ringCursor{safe: safeRing, unsafe: unsafeRing}
+}
+
+/**
+Find the next node which satisfies the condition.
+Safe nodes are always preferred to the unsafe nodes.
+Return nil if there is no such node.
+*/
+func (cursor *ringCursor) next(fits func(*spool.ActiveNode) bool) *spool.ActiveNode {
+	if node := walkRing(&cursor.safe, fits); node != nil {
+		return node
+	}
+
+	return walkRing(&cursor.unsafe, fits)
+}
+
+/**
+Walk the ring at most one round until finding the node which satisfies the condition.
+*/
+func walkRing(r **ring.Ring, fits func(*spool.ActiveNode) bool) *spool.ActiveNode {
+	if *r == nil {
+		return nil
+	}
+
+	for i, n := 0, (*r).Len(); i < n; i++ {
+		node := (*r).Value.(*spool.ActiveNode)
+		*r = (*r).Next()
+
+		if fits(node) {
+			return node
+		}
+	}
+
+	return nil
+}
+
+/**
+Failure domains of the shards which belong to one file.
+
+If more shards than the parity count are on the same node, clowder or zone,
+losing it makes the file unrecoverable. So the count of shards per domain
+is limited to the parity count.
+*/
+type failureDomains struct {
+	limit     int
+	zoneAware bool
+	machines  map[string]int
+	clowders  map[string]int
+	zones     map[string]int
+	excluded  map[string]bool
+}
+
+func newFailureDomains(limit int) *failureDomains {
+	return &failureDomains{
+		limit:     limit,
+		zoneAware: viper.GetBool("PLACEMENT.ZONE_AWARE"),
+		machines:  make(map[string]int),
+		clowders:  make(map[string]int),
+		zones:     make(map[string]int),
+		excluded:  make(map[string]bool),
+	}
+}
+
+/**
+Load the failure domains of the file's shards which are already placed.
+The shards which will be moved are excluded.
+*/
+func loadFailureDomains(tx *gorm.DB, fileID uint, excludedShards []string) (*failureDomains, error) {
+	// the limit depends on the erasure profile of the file
+	fileModel := &model.File{}
+	if err := tx.Select("id, parity_shards").First(fileModel, fileID).Error; err != nil {
+		return nil, err
+	}
+
+	domains := newFailureDomains(int(fileModel.ParityShards))
+
+	nodes := make([]*model.Node, 0)
+	query := tx.Table("shards").
+		Select("nodes.machine_id, nodes.clowder_google_id, nodes.zone").
+		Joins("JOIN nodes ON nodes.machine_id = shards.machine_id").
+		Where("shards.file_id = ?", fileID)
+	if len(excludedShards) != 0 {
+		query = query.Where("shards.name NOT IN (?)", excludedShards)
+	}
+
+	if err := query.Scan(&nodes).Error; err != nil && !gorm.IsRecordNotFoundError(err) {
+		return nil, err
+	}
+
+	for _, node := range nodes {
+		domains.add(node)
+	}
+
+	return domains, nil
+}
+
+/**
+Check whether if one more shard can be placed on the node.
+*/
+func (domains *failureDomains) allows(node *model.Node) bool {
+	if domains.excluded[node.MachineID] {
+		return false
+	}
+
+	if domains.machines[node.MachineID] >= domains.limit {
+		return false
+	}
+
+	if domains.clowders[node.ClowderGoogleID] >= domains.limit {
+		return false
+	}
+
+	if domains.zoneAware && node.Zone != "" && domains.zones[node.Zone] >= domains.limit {
+		return false
+	}
+
+	return true
+}
+
+/**
+Exclude the node from the placement of the file's shards.
+*/
+func (domains *failureDomains) exclude(machineID string) {
+	domains.excluded[machineID] = true
+}
+
+/**
+Count the shard which is placed on the node.
+*/
+func (domains *failureDomains) add(node *model.Node) {
+	domains.machines[node.MachineID]++
+	domains.clowders[node.ClowderGoogleID]++
+	if node.Zone != "" {
+		domains.zones[node.Zone]++
+	}
+}
+
+/**
+Find the node which can store the shard within the failure domains
+and reserve the space of the shard on it.
+*/
+func placeShard(cursor *ringCursor, domains *failureDomains, name string, size int) (*spool.ActiveNode, error) {
+	node := cursor.next(func(node *spool.ActiveNode) bool {
+		return domains.allows(node.Model) && node.Reserve(name, uint64(size))
+	})
+
+	if node == nil {
+		// distinguish whether if the storage itself is lacked
+		hasSpace := cursor.next(func(node *spool.ActiveNode) bool {
+			return node.Available() >= uint64(size)
+		}) != nil
+
+		if hasSpace {
+			return nil, ErrLackOfFailureDomains
+		}
+
+		return nil, ErrLackOfStorage
+	}
+
+	domains.add(node.Model)
+
+	return node, nil
+}
+
+/**
+Release the reservations of the scheduled shards which will not be saved.
+*/
+func releaseQuotas(quotas map[*spool.ActiveNode][]*model.ShardToSave) {
+	for node, shards := range quotas {
+		for _, shard := range shards {
+			node.Release(shard.Name)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package operationq
+
+import (
+	"container/ring"
+	"testing"
+
+	"github.com/team836/clowd-storage/internal/model"
+	"github.com/team836/clowd-storage/internal/module/spool"
+)
+
+func newTestRing(machineIDs ...string) *ring.Ring {
+	if len(machineIDs) == 0 {
+		return nil
+	}
+
+	r := ring.New(len(machineIDs))
+	for _, machineID := range machineIDs {
+		r.Value = &spool.ActiveNode{Model: &model.Node{MachineID: machineID}}
+		r = r.Next()
+	}
+
+	return r
+}
+
+func TestRingCursor(t *testing.T) {
+	tests := []struct {
+		name    string
+		safe    []string
+		unsafe  []string
+		allowed map[string]bool
+		want    []string // machine ids of the found nodes, empty if not found
+	}{
+		{"round robin", []string{"a", "b"}, nil, nil, []string{"a", "b", "a"}},
+		{"safe first", []string{"a"}, []string{"x"}, nil, []string{"a", "a"}},
+		{"unsafe when no safe fits", []string{"a"}, []string{"x", "y"}, map[string]bool{"x": true, "y": true}, []string{"x", "y"}},
+		{"skip what does not fit", []string{"a", "b", "c"}, nil, map[string]bool{"c": true}, []string{"c", "c"}},
+		{"nothing fits", []string{"a"}, []string{"x"}, map[string]bool{}, []string{""}},
+		{"empty rings", nil, nil, nil, []string{""}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cursor := newRingCursor(newTestRing(test.safe...), newTestRing(test.unsafe...))
+			fits := func(node *spool.ActiveNode) bool {
+				return test.allowed == nil || test.allowed[node.Model.MachineID]
+			}
+
+			for idx, want := range test.want {
+				got := ""
+				if node := cursor.next(fits); node != nil {
+					got = node.Model.MachineID
+				}
+
+				if got != want {
+					t.Errorf("next() #%d = %q, want %q", idx, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFailureDomainsAllows(t *testing.T) {
+	nodeA := &model.Node{MachineID: "a", ClowderGoogleID: "alice", Zone: "seoul"}
+	nodeB := &model.Node{MachineID: "b", ClowderGoogleID: "alice", Zone: "busan"}
+	nodeC := &model.Node{MachineID: "c", ClowderGoogleID: "bob", Zone: "seoul"}
+	nodeD := &model.Node{MachineID: "d", ClowderGoogleID: "carol"}
+	nodeE := &model.Node{MachineID: "e", ClowderGoogleID: "dave"}
+
+	tests := []struct {
+		name      string
+		limit     int
+		zoneAware bool
+		placed    []*model.Node
+		excluded  []string
+		node      *model.Node
+		want      bool
+	}{
+		{"empty", 1, true, nil, nil, nodeA, true},
+		{"node under the limit", 2, false, []*model.Node{nodeA}, nil, nodeA, true},
+		{"node at the limit", 1, false, []*model.Node{nodeA}, nil, nodeA, false},
+		{"clowder at the limit", 1, false, []*model.Node{nodeA}, nil, nodeB, false},
+		{"clowder under the limit", 2, false, []*model.Node{nodeA}, nil, nodeB, true},
+		{"other clowder", 1, false, []*model.Node{nodeA}, nil, nodeD, true},
+		{"zone at the limit", 1, true, []*model.Node{nodeA}, nil, nodeC, false},
+		{"zone is ignored without zone awareness", 1, false, []*model.Node{nodeA}, nil, nodeC, true},
+		{"other zone", 1, true, []*model.Node{nodeC}, nil, nodeB, true},
+		{"undeclared zones are not one zone", 1, true, []*model.Node{nodeD}, nil, nodeE, true},
+		{"excluded node", 3, true, nil, []string{"a"}, nodeA, false},
+		{"other node than the excluded one", 3, true, nil, []string{"a"}, nodeD, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			domains := newFailureDomains(test.limit)
+			domains.zoneAware = test.zoneAware
+
+			for _, node := range test.placed {
+				domains.add(node)
+			}
+			for _, machineID := range test.excluded {
+				domains.exclude(machineID)
+			}
+
+			if got := domains.allows(test.node); got != test.want {
+				t.Errorf("allows(%s) = %v, want %v", test.node.MachineID, got, test.want)
+			}
+		})
+	}
+}
+
+func TestFailureDomainsSpread(t *testing.T) {
+	// four clowders whose nodes are in two zones
+	nodes := []*model.Node{
+		{MachineID: "a", ClowderGoogleID: "alice", Zone: "seoul"},
+		{MachineID: "b", ClowderGoogleID: "bob", Zone: "seoul"},
+		{MachineID: "c", ClowderGoogleID: "carol", Zone: "busan"},
+		{MachineID: "d", ClowderGoogleID: "dave", Zone: "busan"},
+	}
+
+	tests := []struct {
+		name      string
+		limit     int
+		zoneAware bool
+		shards    int
+		want      int // count of shards which can be placed
+	}{
+		{"every shard fits", 1, false, 4, 4},
+		{"limited by the zones", 1, true, 4, 2},
+		{"limited by the nodes", 2, false, 16, 8},
+		{"limited by the zones before the nodes", 3, true, 16, 6},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			domains := newFailureDomains(test.limit)
+			domains.zoneAware = test.zoneAware
+
+			// place the shards in round robin order like the ring cursor
+			placed := 0
+			for shard := 0; shard < test.shards; shard++ {
+				for idx := range nodes {
+					node := nodes[(shard+idx)%len(nodes)]
+					if domains.allows(node) {
+						domains.add(node)
+						placed++
+						break
+					}
+				}
+			}
+
+			if placed != test.want {
+				t.Errorf("placed %d shards, want %d", placed, test.want)
+			}
+		})
+	}
+}
@@ -28,18 +28,14 @@ func (rq *RestoreQueue) Push(shards ...*model.ShardToLoad) {
 
 /**
 Assign every data shards for restoring to the nodes.
-And update metadata and predict nodes' status by scheduling results.
+And update metadata and reserve the spaces of the nodes by scheduling results.
+Shards of a file are spread so that each node, clowder and zone holds
+at most the parity count of them.
 
-This function change nodes' status. So you SHOULD use this function with
-the `NodesStatusLock` which is mutex for all nodes' status.
+The reservations are released when the scheduling fails,
+so the restorings can be scheduled concurrently.
 */
 func (rq *RestoreQueue) Schedule(safeRing, unsafeRing *ring.Ring) (map[*spool.ActiveNode][]*model.ShardToSave, error) {
-	// define constant for indicating current schedule phase
-	const (
-		Phase1 = 1
-		Phase2 = 2
-	)
-
 	// sort the shards to restore before scheduling
 	rq.sort()
 
@@ -57,48 +53,43 @@ func (rq *RestoreQueue) Schedule(safeRing, unsafeRing *ring.Ring) (map[*spool.Ac
 		return nil, err
 	}
 
-	phase := Phase1
-	prevSafeRing := safeRing
-	prevUnsafeRing := unsafeRing
-	currRing := safeRing
+	// collect the shards to restore for each files
+	restoredShards := make(map[uint][]string)
+	for _, shard := range rq.Shards {
+		restoredShards[shard.Model.FileID] = append(restoredShards[shard.Model.FileID], shard.Model.Name)
+	}
+
+	cursor := newRingCursor(safeRing, unsafeRing)
+	domainsOfFiles := make(map[uint]*failureDomains)
 	quotas := make(map[*spool.ActiveNode][]*model.ShardToSave)
 
 	// for every shards
 	for _, shard := range rq.Shards {
-		// if curr phase is phase2, change current phase to phase1
-		// and move curr ring to previous safe ring
-		if phase == Phase2 {
-			phase = Phase1
-			prevUnsafeRing = currRing
-			currRing = prevSafeRing
+		// load failure domains of the remaining shards of the file
+		domains, ok := domainsOfFiles[shard.Model.FileID]
+		if !ok {
+			var err error
+			domains, err = loadFailureDomains(tx, shard.Model.FileID, restoredShards[shard.Model.FileID])
+			if err != nil {
+				tx.Rollback()
+				releaseQuotas(quotas)
+				return nil, err
+			}
+
+			domainsOfFiles[shard.Model.FileID] = domains
 		}
 
-		tolerance := 0
+		// the shard is restored to the another node
+		domains.exclude(shard.Model.MachineID)
+
 		// find the node which can store this shard
-		for currRing.Value.(*spool.ActiveNode).Status.Capacity < uint64(len(shard.Data)) {
-			currRing = currRing.Next()
-
-			tolerance++
-			if tolerance >= currRing.Len() {
-				if phase == Phase1 {
-					// change to phase2 when
-					// no longer there are none possible things among the safe nodes
-					phase = Phase2
-					prevSafeRing = currRing   // save current safe ring
-					currRing = prevUnsafeRing // move curr ring to previous unsafe ring
-					tolerance = 0
-				} else if phase == Phase2 {
-					// reach at this point when
-					// no longer there are none possible things among the all nodes
-					tx.Rollback() // rollback the transaction
-					return nil, ErrLackOfStorage
-				}
-			}
+		currNode, err := placeShard(cursor, domains, shard.Model.Name, len(shard.Data))
+		if err != nil {
+			tx.Rollback() // rollback the transaction
+			releaseQuotas(quotas)
+			return nil, err
 		}
 
-		// set current node
-		currNode := currRing.Value.(*spool.ActiveNode)
-
 		// Before the update metadata,
 		// this shard data on the previous node must be deleted when the node is reconnected.
 		// Because it will be copied to another active node right now.
@@ -106,8 +97,14 @@ func (rq *RestoreQueue) Schedule(safeRing, unsafeRing *ring.Ring) (map[*spool.Ac
 		tx.Create(&model.DeletedShard{Name: shard.Model.Name, MachineID: shard.Model.MachineID})
 
 		// update machine id of shard record
-		if err := tx.Model(shard.Model).Update("machine_id", currNode.Model.MachineID).Error; err != nil {
+		// The shard is pending until the new node acknowledges it.
+		err = tx.Model(shard.Model).
+			Updates(map[string]interface{}{"machine_id": currNode.Model.MachineID, "state": model.ShardPending}).
+			Error
+		if err != nil {
 			tx.Rollback()
+			currNode.Release(shard.Model.Name)
+			releaseQuotas(quotas)
 			return nil, err
 		}
 
@@ -119,15 +116,21 @@ func (rq *RestoreQueue) Schedule(safeRing, unsafeRing *ring.Ring) (map[*spool.Ac
 				Data: shard.Data,
 			},
 		)
+	}
 
-		// node status prediction
-		currNode.Status.Capacity -= uint64(len(shard.Data))
-
-		currRing = currRing.Next()
+	// the reconstructed data is verified by the server,
+	// so the shards without challenges can be audited from now on
+	if err := PrepareChallenges(tx, rq.Shards); err != nil {
+		tx.Rollback()
+		releaseQuotas(quotas)
+		return nil, err
 	}
 
 	// commit the transaction
-	tx.Commit()
+	if err := tx.Commit().Error; err != nil {
+		releaseQuotas(quotas)
+		return nil, err
+	}
 
 	return quotas, nil
 }
@@ -0,0 +1,114 @@
+package operationq
+
+import (
+	"time"
+
+	"github.com/team836/clowd-storage/internal/model"
+	"github.com/team836/clowd-storage/internal/module/spool"
+	"github.com/team836/clowd-storage/pkg/database"
+	"github.com/team836/clowd-storage/pkg/logger"
+)
+
+const (
+	// time allowed to hand the shards over to the node
+	saveSendWait = 10 * time.Second
+)
+
+/**
+Save the scheduled quotas on the nodes concurrently and wait for the acknowledgements.
+The acknowledged shards are committed, and the others are returned with their data
+so that they can be placed again.
+The shards sent to the node which cannot acknowledge them stay pending,
+and the repair commits them after verifying them by loading.
+The reservations of the shards are converted to the usage of the nodes or released.
+*/
+func SaveQuotas(quotas map[*spool.ActiveNode][]*model.ShardToSave) []*model.ShardToSave {
+	done := make(chan *spool.SaveChan, len(quotas))
+	nodes := make(map[*spool.SaveChan]*spool.ActiveNode, len(quotas))
+	for activeNode, shards := range quotas {
+		saveChan := &spool.SaveChan{Shards: shards, Done: done}
+		nodes[saveChan] = activeNode
+
+		go func(a *spool.ActiveNode, s *spool.SaveChan) {
+			select {
+			case a.Save <- s:
+			case <-a.Closed(): // the node is disconnected after scheduling
+				s.Done <- s
+			case <-time.After(saveSendWait):
+				s.Done <- s
+			}
+		}(activeNode, saveChan)
+	}
+
+	unacked := make([]*model.ShardToSave, 0)
+	for range quotas {
+		saveChan := <-done
+
+		acked := make(map[string]bool, len(saveChan.Acked))
+		for _, name := range saveChan.Acked {
+			acked[name] = true
+		}
+
+		unverified := make(map[string]bool, len(saveChan.Unverified))
+		for _, name := range saveChan.Unverified {
+			unverified[name] = true
+		}
+
+		// the shards which cannot be committed are regarded as not saved
+		if err := commitShards(saveChan.Acked); err != nil {
+			logger.File().Errorf("Error committing the acknowledged shards, %s", err)
+			acked = nil
+		}
+
+		activeNode := nodes[saveChan]
+		for _, shard := range saveChan.Shards {
+			if acked[shard.Name] || unverified[shard.Name] {
+				activeNode.Commit(shard.Name)
+			} else {
+				activeNode.Release(shard.Name)
+				unacked = append(unacked, shard)
+			}
+		}
+	}
+
+	return unacked
+}
+
+/**
+Mark the acknowledged shards as committed.
+*/
+func commitShards(names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+
+	return database.Conn().
+		Model(&model.Shard{}).
+		Where("name IN (?) AND state = ?", names, model.ShardPending).
+		Update("state", model.ShardCommitted).
+		Error
+}
+
+/**
+Find the shard records of the unacknowledged shards for placing them again.
+*/
+func ShardsToReplace(unacked []*model.ShardToSave) ([]*model.ShardToLoad, error) {
+	data := make(map[string][]byte, len(unacked))
+	names := make([]string, 0, len(unacked))
+	for _, shard := range unacked {
+		data[shard.Name] = shard.Data
+		names = append(names, shard.Name)
+	}
+
+	shardModels := make([]*model.Shard, 0)
+	if err := database.Conn().Where("name IN (?)", names).Find(&shardModels).Error; err != nil {
+		return nil, err
+	}
+
+	shards := make([]*model.ShardToLoad, 0, len(shardModels))
+	for _, shardModel := range shardModels {
+		shards = append(shards, &model.ShardToLoad{Model: shardModel, Data: data[shardModel.Name]})
+	}
+
+	return shards, nil
+}
@@ -5,6 +5,7 @@ import (
 	"errors"
 	"sort"
 
+	"github.com/spf13/viper"
 	"github.com/team836/clowd-storage/internal/module/spool"
 	"github.com/team836/clowd-storage/pkg/database"
 	"github.com/team836/clowd-storage/pkg/errcorr"
@@ -34,18 +35,14 @@ func (uq *UploadQueue) Push(file *model.EncFile) {
 
 /**
 Assign every data shards for saving to the nodes.
-And update metadata and predict nodes' status by scheduling results.
+And update metadata and reserve the spaces of the nodes by scheduling results.
+Shards of a file are spread so that each node, clowder and zone holds
+at most the parity count of them.
 
-This function change nodes' status. So you SHOULD use this function with
-the `NodesStatusLock` which is mutex for all nodes' status.
+The reservations are released when the scheduling fails,
+so the uploads can be scheduled concurrently.
 */
 func (uq *UploadQueue) Schedule(safeRing, unsafeRing *ring.Ring) (map[*spool.ActiveNode][]*model.ShardToSave, error) {
-	// define constant for indicating current schedule phase
-	const (
-		Phase1 = 1
-		Phase2 = 2
-	)
-
 	// sort the files to upload before scheduling
 	uq.sort()
 
@@ -63,10 +60,8 @@ func (uq *UploadQueue) Schedule(safeRing, unsafeRing *ring.Ring) (map[*spool.Act
 		return nil, err
 	}
 
-	phase := Phase1
-	prevSafeRing := safeRing
-	prevUnsafeRing := unsafeRing
-	currRing := safeRing
+	cursor := newRingCursor(safeRing, unsafeRing)
+	challengeCount := viper.GetInt("AUDIT.CHALLENGES_PER_SHARD")
 	quotas := make(map[*spool.ActiveNode][]*model.ShardToSave)
 
 	// for every files to save
@@ -77,54 +72,62 @@ func (uq *UploadQueue) Schedule(safeRing, unsafeRing *ring.Ring) (map[*spool.Act
 			return nil, err
 		}
 
-		// if curr phase is phase2, change current phase to phase1
-		// and move curr ring to previous safe ring
-		if phase == Phase2 {
-			phase = Phase1
-			prevUnsafeRing = currRing
-			currRing = prevSafeRing
+		// wrap the data key now that the file id is assigned
+		if file.DataKey != nil {
+			if err := file.WrapKey(tx); err != nil {
+				tx.Rollback()
+				releaseQuotas(quotas)
+				return nil, err
+			}
 		}
 
+		// shards of this file are spread over the failure domains
+		domains := newFailureDomains(file.Model.ErasureProfile().ParityShards)
+
 		// for every shards
 		for pos, shard := range file.Data {
-			tolerance := 0
-			// find the node which can store this shard
-			for currRing.Value.(*spool.ActiveNode).Status.Capacity < uint64(len(shard)) {
-				currRing = currRing.Next()
-
-				tolerance++
-				if tolerance >= currRing.Len() {
-					if phase == Phase1 {
-						// change to phase2 when
-						// no longer there are none possible things among the safe nodes
-						phase = Phase2
-						prevSafeRing = currRing   // save current safe ring
-						currRing = prevUnsafeRing // move curr ring to previous unsafe ring
-						tolerance = 0
-					} else if phase == Phase2 {
-						// reach at this point when
-						// no longer there are none possible things among the all nodes
-						tx.Rollback() // rollback the transaction
-						return nil, ErrLackOfStorage
-					}
-				}
+			shardModel := &model.Shard{
+				Position: uint8(pos),
+				FileID:   file.Model.ID,
+				Checksum: errcorr.Checksum(shard),
+				Size:     uint(len(shard)),
+				State:    model.ShardPending, // committed after the node acknowledges it
 			}
+			shardModel.DecideName()
 
-			// set current node
-			currNode := currRing.Value.(*spool.ActiveNode)
+			// find the node which can store this shard
+			currNode, err := placeShard(cursor, domains, shardModel.Name, len(shard))
+			if err != nil {
+				tx.Rollback() // rollback the transaction
+				releaseQuotas(quotas)
+				return nil, err
+			}
 
 			// create the shard record
-			shardModel := &model.Shard{
-				Position:  uint8(pos),
-				FileID:    file.Model.ID,
-				MachineID: currNode.Model.MachineID,
-				Checksum:  errcorr.Checksum(shard),
-			}
-			shardModel.DecideName()
+			shardModel.MachineID = currNode.Model.MachineID
 			if err := tx.Create(shardModel).Error; err != nil {
 				tx.Rollback()
+				currNode.Release(shardModel.Name)
+				releaseQuotas(quotas)
+				return nil, err
+			}
+
+			// precompute the audit challenges of the shard
+			challenges, err := model.NewAuditChallenges(shardModel.Name, shard, challengeCount)
+			if err != nil {
+				tx.Rollback()
+				currNode.Release(shardModel.Name)
+				releaseQuotas(quotas)
 				return nil, err
 			}
+			for _, challenge := range challenges {
+				if err := tx.Create(challenge).Error; err != nil {
+					tx.Rollback()
+					currNode.Release(shardModel.Name)
+					releaseQuotas(quotas)
+					return nil, err
+				}
+			}
 
 			// assignment shard to this node
 			quotas[currNode] = append(
@@ -134,16 +137,14 @@ func (uq *UploadQueue) Schedule(safeRing, unsafeRing *ring.Ring) (map[*spool.Act
 					Data: shard,
 				},
 			)
-
-			// node status prediction
-			currNode.Status.Capacity -= uint64(len(shard))
-
-			currRing = currRing.Next()
 		}
 	}
 
 	// commit the transaction
-	tx.Commit()
+	if err := tx.Commit().Error; err != nil {
+		releaseQuotas(quotas)
+		return nil, err
+	}
 
 	return quotas, nil
 }
@@ -0,0 +1,397 @@
+package repair
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/team836/clowd-storage/internal/model"
+	"github.com/team836/clowd-storage/internal/module/lifecycle"
+	"github.com/team836/clowd-storage/internal/module/operationq"
+	"github.com/team836/clowd-storage/internal/module/reputation"
+	"github.com/team836/clowd-storage/internal/module/spool"
+	"github.com/team836/clowd-storage/pkg/database"
+	"github.com/team836/clowd-storage/pkg/logger"
+)
+
+var (
+	daemon *Daemon   // singleton instance
+	once   sync.Once // for thread safe singleton
+)
+
+/**
+Health of the file which has shards on the lost nodes.
+*/
+type fileHealth struct {
+	FileID     uint
+	LiveShards int
+}
+
+/**
+Daemon which repairs the shards on the lost nodes in background.
+*/
+type Daemon struct {
+	// request the repair immediately
+	Trigger chan bool
+}
+
+/**
+Return the singleton repair daemon instance.
+*/
+func Service() *Daemon {
+	once.Do(func() {
+		daemon = newDaemon()
+	})
+
+	return daemon
+}
+
+/**
+Create new repair daemon.
+*/
+func newDaemon() *Daemon {
+	d := &Daemon{
+		Trigger: make(chan bool, 1), // buffered channel for non-blocking trigger
+	}
+
+	// repair immediately when a node is lost
+	lifecycle.Subscribe(d.onTransition)
+
+	// run the repair periodically
+	go d.run()
+
+	return d
+}
+
+/**
+Run the repair at every interval or when triggered.
+*/
+func (d *Daemon) run() {
+	ticker := time.NewTicker(viper.GetDuration("REPAIR.INTERVAL"))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.Trigger:
+		}
+
+		d.repair()
+	}
+}
+
+/**
+Trigger the repair when a node is lost.
+*/
+func (d *Daemon) onTransition(machineID string, from, to model.NodeState) {
+	if to != model.NodeLost {
+		return
+	}
+
+	select {
+	case d.Trigger <- true:
+	default: // the repair is already triggered
+	}
+}
+
+/**
+Repair the files which have shards on the lost nodes.
+
+- Find the nodes which are in the lost state.
+- Find the files which have shards on those nodes.
+- Order the files by count of live shards, the closest to the recovery threshold first.
+- Download the surviving shards and reconstruct the lost shards.
+- Restore the reconstructed shards to the another nodes.
+*/
+func (d *Daemon) repair() {
+	lostMachineIDs, err := findLostMachines()
+	if err != nil {
+		logger.File().Errorf("Error finding the lost nodes, %s", err)
+		return
+	}
+
+	staleFileIDs, err := findStaleFiles()
+	if err != nil {
+		logger.File().Errorf("Error finding the files which have stale pending shards, %s", err)
+		return
+	}
+
+	// nothing to repair
+	if len(lostMachineIDs) == 0 && len(staleFileIDs) == 0 {
+		return
+	}
+
+	healths, err := findDamagedFiles(lostMachineIDs, staleFileIDs)
+	if err != nil {
+		logger.File().Errorf("Error finding the files to repair, %s", err)
+		return
+	}
+
+	// limit the count of files to repair at once
+	if batchSize := viper.GetInt("REPAIR.BATCH_SIZE"); len(healths) > batchSize {
+		healths = healths[:batchSize]
+	}
+
+	lostMachines := make(map[string]bool)
+	for _, machineID := range lostMachineIDs {
+		lostMachines[machineID] = true
+	}
+
+	reconstructedShards := make([]*model.ShardToLoad, 0)
+	for _, health := range healths {
+		shards, err := repairFile(health.FileID, lostMachines)
+		if err != nil {
+			logger.File().Warnf("Cannot repair the file(%d) currently, %s", health.FileID, err)
+			continue
+		}
+
+		reconstructedShards = append(reconstructedShards, shards...)
+	}
+
+	if err := Restore(reconstructedShards); err != nil {
+		logger.File().Warnf("Cannot restore the reconstructed shards currently, %s", err)
+	}
+}
+
+/**
+Reconstruct the shards of the file on the node from the other shards.
+It is used for the shards which cannot be copied from the node directly.
+*/
+func Reconstruct(fileID uint, machineID string) ([]*model.ShardToLoad, error) {
+	shards, err := repairFile(fileID, map[string]bool{machineID: true})
+	if err != nil {
+		return nil, err
+	}
+
+	// the shards on the temporarily offline nodes are excluded
+	reconstructedShards := make([]*model.ShardToLoad, 0, len(shards))
+	for _, shard := range shards {
+		if shard.Model.MachineID == machineID {
+			reconstructedShards = append(reconstructedShards, shard)
+		}
+	}
+
+	return reconstructedShards, nil
+}
+
+/**
+Find the machine ids of the nodes which are in the lost state.
+*/
+func findLostMachines() ([]string, error) {
+	lostNodes := make([]*model.Node, 0)
+	sqlResult := database.Conn().
+		Where("state = ?", model.NodeLost).
+		Find(&lostNodes)
+
+	if sqlResult.Error != nil && !sqlResult.RecordNotFound() {
+		return nil, sqlResult.Error
+	}
+
+	machineIDs := make([]string, 0)
+	for _, node := range lostNodes {
+		// the node can be reconnected before its state is transited to online
+		if spool.Pool().FindActiveNode(node.MachineID) != nil {
+			continue
+		}
+
+		machineIDs = append(machineIDs, node.MachineID)
+	}
+
+	return machineIDs, nil
+}
+
+/**
+Find the files which have the shards pending longer than the timeout.
+Those shards may not be saved because the server or the node is crashed before the acknowledgement.
+*/
+func findStaleFiles() ([]uint, error) {
+	fileIDs := make([]uint, 0)
+	sqlResult := database.Conn().
+		Table("shards").
+		Where("state = ? AND updated_at < ?", model.ShardPending, staleDeadline()).
+		Pluck("DISTINCT file_id", &fileIDs)
+
+	if sqlResult.Error != nil && !sqlResult.RecordNotFound() {
+		return nil, sqlResult.Error
+	}
+
+	return fileIDs, nil
+}
+
+/**
+Return the time before which the pending shards are stale.
+*/
+func staleDeadline() time.Time {
+	return time.Now().Add(-viper.GetDuration("SAVE.PENDING_TIMEOUT"))
+}
+
+/**
+Whether if the shard is pending longer than the timeout.
+*/
+func isStale(shard *model.Shard) bool {
+	return shard.State == model.ShardPending && shard.UpdatedAt.Before(staleDeadline())
+}
+
+/**
+Find the files which have shards on the lost nodes or stale pending shards
+and sort them by count of live shards in ascending order.
+The shards on the active nodes with poor reputation are not counted as live
+because they are likely to be lost soon.
+*/
+func findDamagedFiles(lostMachineIDs []string, staleFileIDs []uint) ([]*fileHealth, error) {
+	fileIDs := make([]uint, 0)
+	if len(lostMachineIDs) != 0 {
+		sqlResult := database.Conn().
+			Table("shards").
+			Where("machine_id IN (?)", lostMachineIDs).
+			Pluck("DISTINCT file_id", &fileIDs)
+
+		if sqlResult.Error != nil && !sqlResult.RecordNotFound() {
+			return nil, sqlResult.Error
+		}
+	}
+
+	// merge the files which have stale pending shards
+	damaged := make(map[uint]bool, len(fileIDs))
+	for _, fileID := range fileIDs {
+		damaged[fileID] = true
+	}
+	for _, fileID := range staleFileIDs {
+		if !damaged[fileID] {
+			damaged[fileID] = true
+			fileIDs = append(fileIDs, fileID)
+		}
+	}
+
+	if len(fileIDs) == 0 {
+		return nil, nil
+	}
+
+	// collect the active machine ids
+	activeMachineIDs := make([]string, 0)
+	for _, node := range spool.Pool().Snapshot() {
+		activeMachineIDs = append(activeMachineIDs, node.Model.MachineID)
+	}
+
+	// collect the trusted machine ids among them
+	reports, err := reputation.FindReports(activeMachineIDs)
+	if err != nil {
+		return nil, err
+	}
+	trustedMachineIDs := make([]string, 0, len(activeMachineIDs))
+	for _, machineID := range activeMachineIDs {
+		if report, ok := reports[machineID]; ok && report.Score < viper.GetFloat64("REPAIR.MIN_REPUTATION") {
+			continue
+		}
+
+		trustedMachineIDs = append(trustedMachineIDs, machineID)
+	}
+
+	// count the shards on the active nodes for each files
+	liveCounts := make([]*fileHealth, 0)
+	if len(trustedMachineIDs) != 0 {
+		sqlResult := database.Conn().
+			Table("shards").
+			Select("file_id, count(*) as live_shards").
+			Where("file_id IN (?) AND machine_id IN (?)", fileIDs, trustedMachineIDs).
+			Group("file_id").
+			Scan(&liveCounts)
+
+		if sqlResult.Error != nil && !sqlResult.RecordNotFound() {
+			return nil, sqlResult.Error
+		}
+	}
+
+	liveShards := make(map[uint]int)
+	for _, liveCount := range liveCounts {
+		liveShards[liveCount.FileID] = liveCount.LiveShards
+	}
+
+	healths := make([]*fileHealth, 0, len(fileIDs))
+	for _, fileID := range fileIDs {
+		healths = append(healths, &fileHealth{FileID: fileID, LiveShards: liveShards[fileID]})
+	}
+
+	// the file which is closest to the recovery threshold comes first
+	sort.SliceStable(healths, func(i, j int) bool {
+		return healths[i].LiveShards < healths[j].LiveShards
+	})
+
+	return healths, nil
+}
+
+/**
+Download the surviving shards of the file and reconstruct the shards
+which are on the lost nodes or corrupted.
+*/
+func repairFile(fileID uint, lostMachines map[string]bool) ([]*model.ShardToLoad, error) {
+	fileModel := &model.File{}
+	if err := database.Conn().First(fileModel, fileID).Error; err != nil {
+		return nil, err
+	}
+
+	dq := operationq.NewDQ()
+	if err := dq.PushSegment(fileModel); err != nil {
+		return nil, err
+	}
+
+	// download the surviving shards
+	dq.Load(context.Background())
+
+	file := dq.Files[0]
+	profile := fileModel.ErasureProfile()
+	shards := make([][]byte, profile.TotalShards())
+	missedShards := make([]*model.ShardToLoad, 0)
+	for _, loadedShard := range file.Shards {
+		stale := isStale(loadedShard.Model)
+
+		// missing, corrupted or lost shard
+		if loadedShard.Failed {
+			// the shard on the temporarily offline node is not repaired yet
+			// unless it has never been acknowledged
+			if !stale &&
+				!lostMachines[loadedShard.Model.MachineID] &&
+				spool.Pool().FindActiveNode(loadedShard.Model.MachineID) == nil {
+				continue
+			}
+
+			missedShards = append(missedShards, loadedShard)
+			continue
+		}
+
+		// the stale pending shard is actually saved on the node
+		if stale {
+			commitStaleShard(loadedShard.Model)
+		}
+
+		shards[loadedShard.Model.Position] = loadedShard.Data
+	}
+
+	// reconstruct the missing shards
+	if err := profile.Reconstruct(shards); err != nil {
+		return nil, err
+	}
+
+	for _, missedShard := range missedShards {
+		missedShard.Data = shards[missedShard.Model.Position]
+	}
+
+	return missedShards, nil
+}
+
+/**
+Commit the pending shard which is verified by loading it from the node.
+*/
+func commitStaleShard(shard *model.Shard) {
+	err := database.Conn().
+		Model(shard).
+		Where("state = ?", model.ShardPending).
+		Update("state", model.ShardCommitted).
+		Error
+
+	if err != nil {
+		logger.File().Errorf("Error committing the pending shard, %s", err)
+	}
+}
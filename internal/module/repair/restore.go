@@ -0,0 +1,83 @@
+package repair
+
+import (
+	"errors"
+
+	"github.com/team836/clowd-storage/internal/model"
+	"github.com/team836/clowd-storage/internal/module/operationq"
+	"github.com/team836/clowd-storage/internal/module/spool"
+	"github.com/team836/clowd-storage/pkg/logger"
+)
+
+var (
+	ErrNoAvailableNodes = errors.New("available nodes are not exist")
+	ErrNotAcknowledged  = errors.New("some shards are not acknowledged by the nodes")
+)
+
+/**
+Restore(re-upload) the reconstruct shards to the another nodes
+and wait until the nodes acknowledge them.
+*/
+func Restore(reconstructedShards []*model.ShardToLoad) error {
+	unacked, err := RestoreShards(reconstructedShards)
+	if err != nil {
+		return err
+	}
+
+	if len(unacked) != 0 {
+		return ErrNotAcknowledged
+	}
+
+	return nil
+}
+
+/**
+Restore the reconstruct shards like Restore,
+but return the shards which are not acknowledged by the nodes.
+The unacknowledged shards remain pending, and they are repaired later.
+*/
+func RestoreShards(reconstructedShards []*model.ShardToLoad) ([]*model.ShardToSave, error) {
+	// there are not exists shards to restore
+	if len(reconstructedShards) == 0 {
+		return nil, nil
+	}
+
+	quotas, err := scheduleRestore(reconstructedShards)
+	if err != nil {
+		return nil, err
+	}
+
+	unacked := operationq.SaveQuotas(quotas)
+	if len(unacked) != 0 {
+		logger.File().Warnf("%d shards are not acknowledged while restoring", len(unacked))
+	}
+
+	return unacked, nil
+}
+
+/**
+Schedule restoring for every shards to the nodes.
+The spaces of the nodes are reserved for the shards,
+so the concurrent restorings do not take the same space.
+*/
+func scheduleRestore(shards []*model.ShardToLoad) (map[*spool.ActiveNode][]*model.ShardToSave, error) {
+	rq := operationq.NewRQ()
+	rq.Push(shards...)
+
+	// node selection
+	safeRing, unsafeRing := spool.Pool().SelectNodes()
+	if safeRing.Len()+unsafeRing.Len() == 0 {
+		logger.File().Errorf("Available nodes are not exist.")
+		return nil, ErrNoAvailableNodes
+	}
+
+	// schedule restoring for every shards to the nodes
+	// and get results
+	quotas, err := rq.Schedule(safeRing, unsafeRing)
+	if err != nil {
+		logger.File().Errorf("Error scheduling restoring, %s", err)
+		return nil, err
+	}
+
+	return quotas, nil
+}
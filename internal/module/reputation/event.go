@@ -0,0 +1,72 @@
+package reputation
+
+import (
+	"github.com/jinzhu/gorm"
+	"github.com/team836/clowd-storage/internal/model"
+	"github.com/team836/clowd-storage/pkg/database"
+	"github.com/team836/clowd-storage/pkg/logger"
+)
+
+/**
+Event which affects the reputation of the node.
+*/
+type Event int
+
+const (
+	SaveSucceeded Event = iota
+	SaveFailed
+	LoadSucceeded
+	LoadFailed
+	ChecksumMismatch
+	AuditPassed
+	AuditFailed
+)
+
+/**
+Counter columns increased by each event.
+*/
+var eventColumns = map[Event][]string{
+	SaveSucceeded:    {"saves"},
+	SaveFailed:       {"saves", "failed_saves"},
+	LoadSucceeded:    {"loads"},
+	LoadFailed:       {"loads", "failed_loads"},
+	ChecksumMismatch: {"checksum_mismatches"},
+	AuditPassed:      {"audits_passed"},
+	AuditFailed:      {"audits_failed"},
+}
+
+/**
+Record the event of the node to its reputation.
+*/
+func Record(machineID string, event Event) {
+	columns := make(map[string]interface{})
+	for _, column := range eventColumns[event] {
+		columns[column] = gorm.Expr(column+" + ?", 1)
+	}
+
+	err := database.Conn().
+		Model(&model.NodeReputation{}).
+		Where("machine_id = ?", machineID).
+		UpdateColumns(columns).
+		Error
+
+	if err != nil {
+		logger.File().Errorf("Error recording the reputation of the node, %s", err)
+	}
+}
+
+/**
+Save the smoothed failure rate of the node,
+so the next connection of the node starts from it.
+*/
+func SaveFailureRate(machineID string, failureRate float64) {
+	err := database.Conn().
+		Model(&model.NodeReputation{}).
+		Where("machine_id = ?", machineID).
+		UpdateColumn("failure_rate", failureRate).
+		Error
+
+	if err != nil {
+		logger.File().Errorf("Error saving the failure rate of the node, %s", err)
+	}
+}
@@ -0,0 +1,178 @@
+package reputation
+
+import (
+	"math"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/team836/clowd-storage/internal/model"
+	"github.com/team836/clowd-storage/pkg/database"
+)
+
+const (
+	// score of the node which has no history
+	neutralScore = 0.5
+)
+
+/**
+Reputation report of the node.
+*/
+type Report struct {
+	MachineID          string  `json:"machineId"`
+	Uptime             float64 `json:"uptime"` // percentage in the reputation window
+	Saves              uint    `json:"saves"`
+	FailedSaves        uint    `json:"failedSaves"`
+	Loads              uint    `json:"loads"`
+	FailedLoads        uint    `json:"failedLoads"`
+	ChecksumMismatches uint    `json:"checksumMismatches"`
+	AuditsPassed       uint    `json:"auditsPassed"`
+	AuditsFailed       uint    `json:"auditsFailed"`
+	FailureRate        float64 `json:"failureRate"` // smoothed failure rate of the recent operations
+	Score              float64 `json:"score"`       // in [0, 1], the higher is the more reliable
+}
+
+/**
+Find the reputation reports of the nodes.
+The node which has no reputation record is not in the result.
+*/
+func FindReports(machineIDs []string) (map[string]*Report, error) {
+	reports := make(map[string]*Report)
+	if len(machineIDs) == 0 {
+		return reports, nil
+	}
+
+	reputations := make([]*model.NodeReputation, 0)
+	sqlResult := database.Conn().
+		Where("machine_id IN (?)", machineIDs).
+		Find(&reputations)
+
+	if sqlResult.Error != nil && !sqlResult.RecordNotFound() {
+		return nil, sqlResult.Error
+	}
+
+	uptimes, err := findUptimes(reputations)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, reputation := range reputations {
+		report := &Report{
+			MachineID:          reputation.MachineID,
+			Uptime:             uptimes[reputation.MachineID] * 100,
+			Saves:              reputation.Saves,
+			FailedSaves:        reputation.FailedSaves,
+			Loads:              reputation.Loads,
+			FailedLoads:        reputation.FailedLoads,
+			ChecksumMismatches: reputation.ChecksumMismatches,
+			AuditsPassed:       reputation.AuditsPassed,
+			AuditsFailed:       reputation.AuditsFailed,
+			FailureRate:        reputation.FailureRate,
+		}
+		report.Score = report.score()
+
+		reports[reputation.MachineID] = report
+	}
+
+	return reports, nil
+}
+
+/**
+Find the reputation report of the node.
+The node which has no history gets the neutral score.
+*/
+func FindReport(machineID string) (*Report, error) {
+	reports, err := FindReports([]string{machineID})
+	if err != nil {
+		return nil, err
+	}
+
+	if report, ok := reports[machineID]; ok {
+		return report, nil
+	}
+
+	return &Report{MachineID: machineID, Score: neutralScore}, nil
+}
+
+/**
+Calculate the reputation score by averaging uptime,
+success ratio of the operations and pass ratio of the audits.
+*/
+func (report *Report) score() float64 {
+	operations := float64(report.Saves + report.Loads)
+	failures := float64(report.FailedSaves + report.FailedLoads + report.ChecksumMismatches)
+	operationScore := neutralScore
+	if operations > 0 {
+		operationScore = math.Max(1-failures/operations, 0)
+	}
+
+	audits := float64(report.AuditsPassed + report.AuditsFailed)
+	auditScore := neutralScore
+	if audits > 0 {
+		auditScore = float64(report.AuditsPassed) / audits
+	}
+
+	return (report.Uptime/100 + operationScore + auditScore) / 3
+}
+
+/**
+Calculate the uptime ratio of the nodes in the reputation window.
+The window starts from the first seen time for the new nodes.
+*/
+func findUptimes(reputations []*model.NodeReputation) (map[string]float64, error) {
+	uptimes := make(map[string]float64)
+	if len(reputations) == 0 {
+		return uptimes, nil
+	}
+
+	now := time.Now()
+	windowStart := now.Add(-viper.GetDuration("REPUTATION.WINDOW"))
+
+	machineIDs := make([]string, 0, len(reputations))
+	for _, reputation := range reputations {
+		machineIDs = append(machineIDs, reputation.MachineID)
+	}
+
+	sessions := make([]*model.NodeSession, 0)
+	sqlResult := database.Conn().
+		Where("machine_id IN (?) AND (disconnected_at IS NULL OR disconnected_at > ?)", machineIDs, windowStart).
+		Find(&sessions)
+
+	if sqlResult.Error != nil && !sqlResult.RecordNotFound() {
+		return nil, sqlResult.Error
+	}
+
+	// sum the connected time in the window
+	connected := make(map[string]time.Duration)
+	for _, session := range sessions {
+		start := session.ConnectedAt
+		if start.Before(windowStart) {
+			start = windowStart
+		}
+
+		end := now
+		if session.DisconnectedAt != nil {
+			end = *session.DisconnectedAt
+		}
+
+		if end.After(start) {
+			connected[session.MachineID] += end.Sub(start)
+		}
+	}
+
+	for _, reputation := range reputations {
+		start := reputation.FirstSeenAt
+		if start.Before(windowStart) {
+			start = windowStart
+		}
+
+		observed := now.Sub(start)
+		if observed <= 0 {
+			uptimes[reputation.MachineID] = 1
+			continue
+		}
+
+		uptimes[reputation.MachineID] = math.Min(connected[reputation.MachineID].Seconds()/observed.Seconds(), 1)
+	}
+
+	return uptimes, nil
+}
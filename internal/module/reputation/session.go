@@ -0,0 +1,56 @@
+package reputation
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/team836/clowd-storage/internal/model"
+	"github.com/team836/clowd-storage/pkg/database"
+)
+
+/**
+Open new session of the connected node.
+
+The sessions which are left open by the server shutdown are closed
+as zero length because their disconnected time is unknown.
+*/
+func OpenSession(machineID string) (*model.NodeSession, error) {
+	now := time.Now()
+
+	// close the dangling sessions
+	err := database.Conn().
+		Model(&model.NodeSession{}).
+		Where("machine_id = ? AND disconnected_at IS NULL", machineID).
+		UpdateColumn("disconnected_at", gorm.Expr("connected_at")).
+		Error
+	if err != nil {
+		return nil, err
+	}
+
+	// create the reputation record if not exists
+	err = database.Conn().
+		Where(&model.NodeReputation{MachineID: machineID}).
+		Attrs(&model.NodeReputation{FirstSeenAt: now}).
+		FirstOrCreate(&model.NodeReputation{}).
+		Error
+	if err != nil {
+		return nil, err
+	}
+
+	session := &model.NodeSession{MachineID: machineID, ConnectedAt: now}
+	if err := database.Conn().Create(session).Error; err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+/**
+Close the session of the disconnected node.
+*/
+func CloseSession(session *model.NodeSession) error {
+	return database.Conn().
+		Model(session).
+		Update("disconnected_at", time.Now()).
+		Error
+}
@@ -1,12 +1,17 @@
 package spool
 
 import (
+	"context"
+	"encoding/json"
 	"sync"
 	"time"
 
+	"github.com/spf13/viper"
 	"github.com/team836/clowd-storage/pkg/database"
 
 	"github.com/team836/clowd-storage/internal/model"
+	"github.com/team836/clowd-storage/internal/module/lifecycle"
+	"github.com/team836/clowd-storage/internal/module/reputation"
 
 	"github.com/team836/clowd-storage/pkg/logger"
 
@@ -23,11 +28,17 @@ const (
 	saveWait = 30 * time.Second
 
 	loadWait = 30 * time.Second
+
+	auditWait = 10 * time.Second
+
+	ackWait = 30 * time.Second
 )
 
 const (
 	maxPongSize = 512
 
+	maxAuditSize = 512
+
 	maxLoadSize = 104857600 // 100MB
 )
 
@@ -37,25 +48,105 @@ const (
 	downloadType = "down"
 
 	deleteType = "delete"
+
+	auditType = "audit"
 )
 
 type shardToDown struct {
 	Name string `json:"name"`
 }
 
+/**
+Audit challenge sent to the node.
+The node SHOULD answer the HMAC-SHA256 of the shard data
+whose key is the hex decoded nonce.
+*/
+type auditChallenge struct {
+	Name  string `json:"name"`
+	Nonce string `json:"nonce"` // hex encoded
+}
+
+type AuditAnswer struct {
+	Name string `json:"name"`
+	Hash string `json:"hash"` // hex encoded
+}
+
+type AuditChan struct {
+	// name of the shard to audit
+	ShardName string
+
+	// hex encoded nonce for the keyed hash
+	Nonce string
+
+	// answer of the node
+	// It is nil when the node doesn't answer, which is not the proof of the missing shard.
+	// It SHOULD be buffered channel for non-blocking at the node
+	Answer chan<- *AuditAnswer
+}
+
+/**
+Acknowledgement of the saved shard.
+*/
+type shardAck struct {
+	Name     string `json:"name"`
+	Checksum string `json:"checksum"` // hex encoded sha256
+}
+
+type SaveChan struct {
+	// shards to save
+	Shards []*model.ShardToSave
+
+	// names of the shards which are acknowledged with the same checksum
+	Acked []string
+
+	// names of the shards which are sent to the node which cannot acknowledge them
+	// They stay pending until the repair verifies them by loading.
+	Unverified []string
+
+	// notify that the saving is finished regardless of success
+	// It SHOULD be buffered channel for non-blocking at the node
+	Done chan<- *SaveChan
+}
+
+/**
+Notify that the saving is finished.
+*/
+func (saveChan *SaveChan) finish() {
+	saveChan.Done <- saveChan
+}
+
 type DataMsg struct {
+	ID       uint32      `json:"id,omitempty"` // correlation id which the node echoes in the response
 	Type     string      `json:"type"`
 	Contents interface{} `json:"contents"`
 }
 
 type LoadChan struct {
+	// cancel the loading, and give up waiting for the node when it is in progress
+	Ctx context.Context
+
+	// shards to load
 	Shards []*model.ShardToLoad
-	WG     *sync.WaitGroup
+
+	// received data in order of the shards
+	// It is nil when the loading is failed.
+	Data [][]byte
+
+	// notify that the loading is finished regardless of success
+	// It SHOULD be buffered channel for non-blocking at the node
+	Done chan<- *LoadChan
+}
+
+/**
+Notify that the loading is finished.
+*/
+func (loadChan *LoadChan) finish() {
+	loadChan.Done <- loadChan
 }
 
 type Status struct {
-	// TODO: measure rtt when ping and pong
-	// round trip time (ms)
+	// round trip time which is reported by the node itself (ms)
+	// It is only for display, because the node can fake it.
 	RTT uint `json:"rtt"`
 
 	// network bandwidth (Mbps)
@@ -64,11 +155,25 @@ type Status struct {
 	// available capacity of the node (Byte)
 	Capacity uint64 `json:"capacity"`
 
+	// smoothed round trip time which is measured by the server
+	SmoothedRTT time.Duration `json:"-"`
+
+	// variation of the measured round trip time
+	RTTVar time.Duration `json:"-"`
+
 	// last checked time for this status
+	// The status is old when the heartbeat has not refreshed it for a while.
 	lastCheckedAt time.Time
 
-	// whether this status is old or not
-	isOld bool
+	// smoothed failure rate of the recent operations (0 ~ 1)
+	// It is carried over from the previous connection of the node.
+	failureRate float64
+
+	// reputation score from the history of the node (0 ~ 1)
+	reputation float64
+
+	// bytes of the shards assigned to the node by the server
+	assigned uint64
 }
 
 type ActiveNode struct {
@@ -78,12 +183,8 @@ type ActiveNode struct {
 	// node status
 	Status *Status
 
-	// send check ping to the node and receive the node's information
-	// It SHOULD be buffered channel for non-blocking at the socket pool
-	Ping chan bool
-
 	// save shards on the node
-	Save chan []*model.ShardToSave
+	Save chan *SaveChan
 
 	// load shards from the node
 	Load chan *LoadChan
@@ -94,165 +195,430 @@ type ActiveNode struct {
 	// flush the deleted shard list to the node
 	Flush chan bool
 
+	// send audit challenge to the node
+	Audit chan *AuditChan
+
 	// websocket connection
 	conn *websocket.Conn
+
+	// connected time of this node
+	connectedAt time.Time
+
+	// session record of this connection
+	// It is nil when the session cannot be recorded.
+	session *model.NodeSession
+
+	// whether if the shards are transferred as binary frames instead of json
+	binary bool
+
+	// features which are enabled by the handshake
+	features map[string]bool
+
+	// serialize the writes on the websocket connection
+	writeLock sync.Mutex
+
+	// requests which wait for the responses by correlation id
+	calls     map[uint32]*call
+	fifo      []uint32 // ids of the json requests in order for the legacy node
+	lastID    uint32
+	callsLock sync.Mutex
+
+	// whether if the node has answered with the correlation id
+	multiplexed bool
+
+	// serialize the status updates by the concurrent operations
+	// It also guards the reservations.
+	statusLock sync.Mutex
+
+	// spaces reserved for the scheduled shards by shard name
+	reservations map[string]*reservation
+
+	// closed when the connection is closed
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// lifecycle state of the node
+	// It is synced with the database by the lifecycle transitions.
+	state     model.NodeState
+	stateLock sync.RWMutex
 }
 
-func NewActiveNode(conn *websocket.Conn, nodeModel *model.Node) *ActiveNode {
+func NewActiveNode(conn *websocket.Conn, nodeModel *model.Node, hello *Hello) *ActiveNode {
+	// start from the reputation and the failure rate of the previous connections
+	report, err := reputation.FindReport(nodeModel.MachineID)
+	if err != nil {
+		logger.File().Errorf("Error finding the reputation of the node, %s", err)
+		report = &reputation.Report{}
+	}
+
+	// the connection which is not unregistered yet has the latest failure rate
+	failureRate := report.FailureRate
+	if old := Pool().FindActiveNode(nodeModel.MachineID); old != nil {
+		old.statusLock.Lock()
+		failureRate = old.Status.failureRate
+		old.statusLock.Unlock()
+	}
+
+	session, err := reputation.OpenSession(nodeModel.MachineID)
+	if err != nil {
+		logger.File().Errorf("Error opening the session of the node, %s", err)
+	}
+
 	c := &ActiveNode{
 		Model: nodeModel,
 		Status: &Status{
 			lastCheckedAt: time.Now().Add(-24 * time.Hour),
-			isOld:         true,
+			reputation:    report.Score,
+			failureRate:   failureRate,
 		},
-		Ping:   make(chan bool, 1), // buffered channel for trying ping
-		Save:   make(chan []*model.ShardToSave),
-		Load:   make(chan *LoadChan),
-		Delete: make(chan []*model.ShardToDelete),
-		Flush:  make(chan bool),
-		conn:   conn,
+		Save:         make(chan *SaveChan),
+		Load:         make(chan *LoadChan),
+		Delete:       make(chan []*model.ShardToDelete),
+		Flush:        make(chan bool),
+		Audit:        make(chan *AuditChan),
+		conn:         conn,
+		connectedAt:  time.Now(),
+		session:      session,
+		state:        nodeModel.State,
+		binary:       hello.enabled[FeatureBinary],
+		features:     hello.enabled,
+		calls:        make(map[uint32]*call),
+		reservations: make(map[string]*reservation),
+		done:         make(chan struct{}),
 	}
 
 	return c
 }
 
+/**
+Check whether if the feature is enabled for the node.
+*/
+func (node *ActiveNode) Supports(feature string) bool {
+	return node.features[feature]
+}
+
 /**
 Run the websocket operations using non-blocking channels.
+Each operation runs concurrently, and the responses are routed by the reader.
 */
 func (node *ActiveNode) Run() {
 	defer func() {
-		Pool().Unregister <- node
+		Pool().Unregister(node)
 	}()
 
+	go node.readLoop()
+	go node.heartbeat()
+
 	for {
 		select {
-		case <-node.Ping:
-			node.conn.SetReadLimit(maxPongSize)
-
-			// send the check ping
-			_ = node.conn.SetWriteDeadline(time.Now().Add(pingWait))
-			if err := node.conn.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
-				logger.File().Infof("Error sending ping to node, %s", err)
-				Pool().pingWaitGroup.Done()
-				return
-			}
-
-			// receive the check pong
-			_ = node.conn.SetReadDeadline(time.Now().Add(pongWait))
-			if err := node.conn.ReadJSON(node.Status); err != nil {
-				logger.File().Infof("Error receiving pong data from node, %s", err)
-				Pool().pingWaitGroup.Done()
-				return
-			}
-
-			// TODO: need to update RTT
-
-			node.Status.lastCheckedAt = time.Now() // update last ping time
-			node.Status.isOld = false
-			Pool().pingWaitGroup.Done()
-		case shards := <-node.Save:
-			_ = node.conn.SetWriteDeadline(time.Now().Add(saveWait))
-
-			// byte array data are send as base64 encoded format
-			if err := node.conn.WriteJSON(DataMsg{Type: uploadType, Contents: shards}); err != nil {
-				logger.File().Errorf("Error saving file to node, %s", err)
-				return
-			}
+		case <-node.done:
+			return
+		case saveChan := <-node.Save:
+			go node.save(saveChan)
 		case loadChan := <-node.Load:
-			node.conn.SetReadLimit(maxLoadSize)
-
-			// make download list
-			shardsToDown := make([]*shardToDown, 0)
-			for _, shard := range loadChan.Shards {
-				shardsToDown = append(
-					shardsToDown,
-					&shardToDown{Name: shard.Model.Name},
-				)
-			}
-
-			// send the download list
-			_ = node.conn.SetWriteDeadline(time.Now().Add(msgSendWait))
-			if err := node.conn.WriteJSON(DataMsg{Type: downloadType, Contents: shardsToDown}); err != nil {
-				logger.File().Infof("Error sending download list to node, %s", err)
-				loadChan.WG.Done()
-				return
-			}
-
-			receivedShards := make([]*model.ShardToSave, 0)
-
-			// receive the shards data
-			_ = node.conn.SetReadDeadline(time.Now().Add(loadWait))
-			if err := node.conn.ReadJSON(&receivedShards); err != nil {
-				logger.File().Infof("Error downloading data from node, %s", err)
-				loadChan.WG.Done()
-				return
-			}
-
-			// if count of shards is different
-			if len(loadChan.Shards) != len(receivedShards) {
-				logger.File().Infof("Count of shards is different, maybe malformed data")
-				loadChan.WG.Done()
-				return
-			}
-
-			// copy shard data
-			for idx, receivedShard := range receivedShards {
-				// check if whether received data name is same
-				if loadChan.Shards[idx].Model.Name != receivedShard.Name {
-					logger.File().Infof("Shard name is different, maybe malformed data")
-					loadChan.WG.Done()
-					return
-				}
-
-				loadChan.Shards[idx].Data = receivedShard.Data
-			}
-
-			loadChan.WG.Done()
+			go node.load(loadChan)
 		case shards := <-node.Delete:
-			_ = node.conn.SetWriteDeadline(time.Now().Add(msgSendWait))
-
-			// send the deletion list
-			if err := node.conn.WriteJSON(DataMsg{Type: deleteType, Contents: shards}); err != nil {
-				// record to database for later deletion because currently cannot delete
-				for _, shard := range shards {
-					database.Conn().
-						Create(&model.DeletedShard{Name: shard.Name, MachineID: node.Model.MachineID})
-				}
-
-				logger.File().Errorf("Error sending deletion list to node, %s", err)
-				return
-			}
+			go node.delete(shards)
+		case auditChan := <-node.Audit:
+			go node.audit(auditChan)
 		case <-node.Flush:
-			_ = node.conn.SetWriteDeadline(time.Now().Add(msgSendWait))
+			go node.flush()
+		}
+	}
+}
+
+/**
+Send the check ping and receive the node's status.
+*/
+func (node *ActiveNode) ping() {
+	// send the check ping
+	pingSentAt := time.Now()
+	c, err := node.requestPing(pingWait)
+	if err != nil {
+		logger.File().Infof("Error sending ping to node, %s", err)
+		node.recordResult(true)
+		return
+	}
+
+	// receive the check pong
+	responses, err := node.await(c, pongWait)
+	if err != nil {
+		logger.File().Infof("Error receiving pong data from node, %s", err)
+		node.recordResult(true)
+		return
+	}
+
+	// the pong is the small status message
+	if len(responses[0].payload) > maxPongSize {
+		logger.File().Infof("Error receiving pong data from node, too large pong")
+		node.recordResult(true)
+		return
+	}
+
+	reported := &Status{}
+	if err := json.Unmarshal(responses[0].payload, reported); err != nil {
+		logger.File().Infof("Error receiving pong data from node, %s", err)
+		node.recordResult(true)
+		return
+	}
+
+	node.statusLock.Lock()
+	node.Status.RTT = reported.RTT
+	node.Status.Bandwidth = reported.Bandwidth
+	node.Status.Capacity = reported.Capacity
+
+	// update rtt by the time from ping to pong
+	node.Status.updateRTT(time.Since(pingSentAt))
+
+	node.Status.lastCheckedAt = time.Now() // update last ping time
+	node.statusLock.Unlock()
+
+	// compare the reported capacity with the server side accounting
+	node.refreshCapacity()
+
+	node.recordResult(false)
+}
+
+/**
+Save the shards on the node and collect the acknowledged shards.
+*/
+func (node *ActiveNode) save(saveChan *SaveChan) {
+	defer saveChan.finish()
+
+	acked, err := node.saveShards(saveChan.Shards)
+	if err != nil {
+		logger.File().Errorf("Error saving file to node, %s", err)
+	}
+
+	// the sent shards are not the proof of the saving for the node without the acknowledgement
+	if !node.Supports(FeatureAck) {
+		if err == nil {
+			saveChan.Unverified = shardNames(saveChan.Shards)
+		}
+
+		node.recordResult(err != nil)
+		return
+	}
+	saveChan.Acked = acked
+
+	failed := len(acked) != len(saveChan.Shards)
+	node.recordResult(failed)
+	if failed {
+		reputation.Record(node.Model.MachineID, reputation.SaveFailed)
+	} else {
+		reputation.Record(node.Model.MachineID, reputation.SaveSucceeded)
+	}
+}
+
+/**
+Return the channel which is closed when the connection is closed.
+*/
+func (node *ActiveNode) Closed() <-chan struct{} {
+	return node.done
+}
 
-			flushList := make([]*model.DeletedShard, 0)
+/**
+Load the shards from the node.
+*/
+func (node *ActiveNode) load(loadChan *LoadChan) {
+	defer loadChan.finish()
+
+	// the loading is already canceled
+	if loadChan.Ctx.Err() != nil {
+		return
+	}
+
+	// request and receive the shards data
+	data, err := node.loadShards(loadChan.Ctx, loadChan.Shards)
+	if err != nil {
+		// the loading is given up by the requester, not failed by the node
+		if loadChan.Ctx.Err() != nil {
+			return
+		}
 
-			// get flush list from the database
+		logger.File().Infof("Error downloading data from node, %s", err)
+		node.recordResult(true)
+		reputation.Record(node.Model.MachineID, reputation.LoadFailed)
+
+		// the malformed data means the broken protocol
+		if err == errMalformedShards {
+			node.close()
+		}
+		return
+	}
+	loadChan.Data = data
+
+	node.recordResult(false)
+	reputation.Record(node.Model.MachineID, reputation.LoadSucceeded)
+}
+
+/**
+Delete the shards on the node.
+*/
+func (node *ActiveNode) delete(shards []*model.ShardToDelete) {
+	// send the deletion list
+	if err := node.writeJSON(&DataMsg{ID: node.nextID(), Type: deleteType, Contents: shards}, msgSendWait); err != nil {
+		// record to database for later deletion because currently cannot delete
+		for _, shard := range shards {
 			database.Conn().
-				Where("machine_id = ?", node.Model.MachineID).
-				Find(&flushList)
-
-			// if flush list is not empty
-			if len(flushList) != 0 {
-				// make deletion list
-				shards := make([]*model.ShardToDelete, 0)
-				for _, delShard := range flushList {
-					shards = append(shards, &model.ShardToDelete{Name: delShard.Name})
-				}
-
-				// send the deletion list to the node
-				if err := node.conn.WriteJSON(DataMsg{Type: deleteType, Contents: shards}); err != nil {
-					logger.File().Errorf("Error flushing deletion list to node, %s", err)
-					return
-				}
-
-				// at this point, deletion is success
-				// so delete records of deletion list
-				for _, flushedShard := range flushList {
-					database.Conn().
-						Delete(flushedShard)
-				}
-			}
+				Create(&model.DeletedShard{Name: shard.Name, MachineID: node.Model.MachineID})
 		}
+
+		logger.File().Errorf("Error sending deletion list to node, %s", err)
+	}
+}
+
+/**
+Send the audit challenge to the node and pass its answer.
+*/
+func (node *ActiveNode) audit(auditChan *AuditChan) {
+	// send the challenge
+	challenge := &auditChallenge{Name: auditChan.ShardName, Nonce: auditChan.Nonce}
+	c, err := node.requestJSON(auditType, challenge, msgSendWait)
+	if err != nil {
+		logger.File().Infof("Error sending audit challenge to node, %s", err)
+		auditChan.Answer <- nil
+		return
+	}
+
+	// receive the answer
+	responses, err := node.await(c, auditWait)
+	if err != nil {
+		logger.File().Infof("Error receiving audit answer from node, %s", err)
+		auditChan.Answer <- nil
+		return
+	}
+
+	answer := &AuditAnswer{}
+	if len(responses[0].payload) > maxAuditSize || json.Unmarshal(responses[0].payload, answer) != nil {
+		logger.File().Infof("Error receiving audit answer from node, malformed answer")
+		auditChan.Answer <- nil
+		return
+	}
+
+	// answer for another shard is judged as wrong by the auditor
+	auditChan.Answer <- answer
+}
+
+/**
+Flush the deleted shard list to the node.
+*/
+func (node *ActiveNode) flush() {
+	flushList := make([]*model.DeletedShard, 0)
+
+	// get flush list from the database
+	database.Conn().
+		Where("machine_id = ?", node.Model.MachineID).
+		Find(&flushList)
+
+	// if flush list is empty
+	if len(flushList) == 0 {
+		return
+	}
+
+	// make deletion list
+	shards := make([]*model.ShardToDelete, 0)
+	for _, delShard := range flushList {
+		shards = append(shards, &model.ShardToDelete{Name: delShard.Name})
+	}
+
+	// send the deletion list to the node
+	if err := node.writeJSON(&DataMsg{ID: node.nextID(), Type: deleteType, Contents: shards}, msgSendWait); err != nil {
+		logger.File().Errorf("Error flushing deletion list to node, %s", err)
+		return
+	}
+
+	// at this point, deletion is success
+	// so delete records of deletion list
+	for _, flushedShard := range flushList {
+		database.Conn().
+			Delete(flushedShard)
+	}
+}
+
+/**
+Record the last seen time of the node to the database.
+*/
+func (node *ActiveNode) updateLastSeen() {
+	err := database.Conn().
+		Model(node.Model).
+		Update("last_seen_at", time.Now()).
+		Error
+
+	if err != nil {
+		logger.File().Errorf("Error updating last seen time of the node, %s", err)
+	}
+}
+
+/**
+Close the session record of this connection.
+*/
+func (node *ActiveNode) closeSession() {
+	if node.session == nil {
+		return
+	}
+
+	if err := reputation.CloseSession(node.session); err != nil {
+		logger.File().Errorf("Error closing the session of the node, %s", err)
+	}
+}
+
+/**
+Save the failure rate of this connection for the next connection.
+*/
+func (node *ActiveNode) saveFailureRate() {
+	node.statusLock.Lock()
+	failureRate := node.Status.failureRate
+	node.statusLock.Unlock()
+
+	reputation.SaveFailureRate(node.Model.MachineID, failureRate)
+}
+
+/**
+Return the lifecycle state of the node.
+*/
+func (node *ActiveNode) State() model.NodeState {
+	node.stateLock.RLock()
+	defer node.stateLock.RUnlock()
+
+	return node.state
+}
+
+/**
+Update the cached lifecycle state of the node.
+*/
+func (node *ActiveNode) setState(state model.NodeState) {
+	node.stateLock.Lock()
+	defer node.stateLock.Unlock()
+
+	node.state = state
+}
+
+/**
+Transit the lifecycle state of the node.
+*/
+func (node *ActiveNode) transit(to model.NodeState) {
+	if _, err := lifecycle.Transit(node.Model.MachineID, to); err != nil {
+		logger.File().Errorf("Error transiting the node(%s) to %s, %s", node.Model.MachineID, to, err)
+	}
+}
+
+/**
+Record the result of the operation and suspect the node
+whose failure rate is too high.
+The suspected node is recovered when its failure rate falls below the half of the threshold.
+*/
+func (node *ActiveNode) recordResult(failed bool) {
+	node.statusLock.Lock()
+	node.Status.recordResult(failed)
+	failureRate := node.Status.failureRate
+	node.statusLock.Unlock()
+
+	threshold := viper.GetFloat64("NODE_STATE.SUSPECT_FAILURE_RATE")
+	switch state := node.State(); {
+	case state == model.NodeOnline && failureRate > threshold:
+		go node.transit(model.NodeSuspect)
+	case state == model.NodeSuspect && failureRate < threshold/2:
+		go node.transit(model.NodeOnline)
 	}
 }
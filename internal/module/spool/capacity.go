@@ -0,0 +1,141 @@
+package spool
+
+import (
+	"time"
+
+	"github.com/team836/clowd-storage/internal/model"
+	"github.com/team836/clowd-storage/pkg/database"
+	"github.com/team836/clowd-storage/pkg/logger"
+)
+
+const (
+	// ratio of the declared storage which the reported free space and the held shards can exceed
+	// by the deleted shards which are not flushed yet
+	capacityTolerance = 0.01
+)
+
+/**
+Return the bytes which can be assigned to the node more.
+It is the smaller of the reported free space and the remaining allocation
+which is declared by the clowder, except the reserved bytes.
+So the free space of the disk beyond the allocation is never used.
+*/
+func (node *ActiveNode) Available() uint64 {
+	node.statusLock.Lock()
+	defer node.statusLock.Unlock()
+
+	return node.available(time.Now())
+}
+
+/**
+Calculate the available bytes.
+You SHOULD use this function with the `statusLock`.
+*/
+func (node *ActiveNode) available(now time.Time) uint64 {
+	reserved := node.reserved(now)
+
+	available := uint64(0)
+	if node.Status.Capacity > reserved {
+		available = node.Status.Capacity - reserved
+	}
+
+	if allocation, declared := node.Model.Allocation(); declared {
+		used := node.Status.assigned + reserved
+
+		remaining := uint64(0)
+		if allocation > used {
+			remaining = allocation - used
+		}
+
+		if remaining < available {
+			available = remaining
+		}
+	}
+
+	return available
+}
+
+/**
+Apply the storage allocation declared by the clowder to the connected node.
+*/
+func (node *ActiveNode) SetAllocation(maxCapacity uint16, declaredAt *time.Time) {
+	node.statusLock.Lock()
+	defer node.statusLock.Unlock()
+
+	node.Model.MaxCapacity = maxCapacity
+	node.Model.CapacityDeclaredAt = declaredAt
+}
+
+/**
+Reload the bytes assigned to the node from the shard table
+and flag the node which reports more free space than it can have.
+
+The node cannot have more free space than its own declared storage except the shards it holds.
+The allocation of the clowder only limits the usage, so it is not compared with the free space.
+*/
+func (node *ActiveNode) refreshCapacity() {
+	assigned := &struct{ Total uint64 }{}
+	err := database.Conn().
+		Model(&model.Shard{}).
+		Select("COALESCE(SUM(size), 0) AS total").
+		Where("machine_id = ? AND state = ?", node.Model.MachineID, model.ShardCommitted).
+		Scan(assigned).
+		Error
+
+	if err != nil {
+		logger.File().Errorf("Error summing the shards of the node, %s", err)
+		return
+	}
+
+	// the pending shards are counted unless they are still reserved,
+	// e.g. sent to the node which cannot acknowledge them
+	pending := make([]*model.Shard, 0)
+	err = database.Conn().
+		Select("name, size").
+		Where("machine_id = ? AND state = ?", node.Model.MachineID, model.ShardPending).
+		Find(&pending).
+		Error
+
+	if err != nil {
+		logger.File().Errorf("Error finding the pending shards of the node, %s", err)
+		return
+	}
+
+	node.statusLock.Lock()
+	for _, shard := range pending {
+		if _, reserved := node.reservations[shard.Name]; !reserved {
+			assigned.Total += uint64(shard.Size)
+		}
+	}
+	node.Status.assigned = assigned.Total
+	reported := node.Status.Capacity
+	node.statusLock.Unlock()
+
+	// the legacy node does not declare its storage
+	declared := node.Model.DeclaredStorage
+	if declared == 0 {
+		return
+	}
+
+	limit := float64(declared) * (1 + capacityTolerance)
+	suspicious := float64(reported+assigned.Total) > limit
+	if suspicious == node.Model.CapacitySuspicious {
+		return
+	}
+
+	if suspicious {
+		logger.File().Warnf(
+			"The node(%s) reports %d bytes free space though it holds %d bytes of %d bytes storage",
+			node.Model.MachineID, reported, assigned.Total, declared,
+		)
+	}
+
+	err = database.Conn().
+		Model(node.Model).
+		Update("capacity_suspicious", suspicious).
+		Error
+
+	if err != nil {
+		logger.File().Errorf("Error flagging the capacity of the node, %s", err)
+	}
+}
@@ -0,0 +1,46 @@
+package spool
+
+type EventType string
+
+const (
+	EventJoin  EventType = "join"
+	EventLeave EventType = "leave"
+)
+
+/**
+Event of the node which joins or leaves the pool.
+*/
+type Event struct {
+	Type EventType
+	Node *ActiveNode
+
+	// whether if the node left because the new connection of same machine replaced it
+	Replaced bool
+}
+
+/**
+Listener which is called after the node joins or leaves the pool.
+*/
+type Listener func(event *Event)
+
+/**
+Register the listener for every join&leave events of the pool.
+*/
+func (pool *SocketPool) Subscribe(listener Listener) {
+	pool.listenersLock.Lock()
+	defer pool.listenersLock.Unlock()
+
+	pool.listeners = append(pool.listeners, listener)
+}
+
+/**
+Call all listeners with the event.
+*/
+func (pool *SocketPool) notify(event *Event) {
+	pool.listenersLock.RLock()
+	defer pool.listenersLock.RUnlock()
+
+	for _, listener := range pool.listeners {
+		listener(event)
+	}
+}
@@ -0,0 +1,237 @@
+package spool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/team836/clowd-storage/internal/model"
+	"github.com/team836/clowd-storage/pkg/database"
+	"github.com/team836/clowd-storage/pkg/frame"
+)
+
+const (
+	// version of the protocol which the server speaks
+	ProtocolVersion = 1
+
+	// the oldest version of the protocol which the server can still speak
+	MinProtocolVersion = 1
+)
+
+const (
+	helloWait = 10 * time.Second
+
+	maxHelloSize = 4096
+)
+
+const (
+	helloType = "hello"
+
+	welcomeType = "welcome"
+)
+
+/**
+Close codes of the websocket which the server sends when refusing the node.
+They are in the range reserved for the applications.
+*/
+const (
+	CloseUnsupportedProtocol = 4001
+
+	CloseBadHandshake = 4002
+)
+
+const (
+	// the node acknowledges the saved shards with their checksum
+	FeatureAck = "ack"
+
+	// the shards are transferred as binary frames
+	FeatureBinary = "binary"
+
+	// the node answers the audit challenges
+	FeatureAudit = "audit"
+
+	// the nodes transfer the shards to each other directly
+	FeatureDirect = "direct"
+
+	// the shards are compressed on the wire
+	FeatureCompression = "compression"
+)
+
+var (
+	ErrBadHandshake        = errors.New("cannot read the hello message from the node")
+	ErrUnsupportedProtocol = errors.New("the protocol version of the node is not supported")
+)
+
+/**
+Hello message which the node sends right after the websocket is opened.
+*/
+type Hello struct {
+	Protocol uint16   `json:"protocol"`
+	Features []string `json:"features"` // features which the node supports
+	Software string   `json:"software"` // software version of the node
+	Storage  uint64   `json:"storage"`  // storage which the node declares (Byte)
+
+	// features which are enabled for this connection
+	enabled map[string]bool
+}
+
+/**
+Answer to the hello message.
+*/
+type welcome struct {
+	Protocol uint16   `json:"protocol"`
+	Features []string `json:"features"` // features which are enabled for the node
+}
+
+/**
+Features which the server can use with the node.
+The binary frames are enabled by the subprotocol.
+*/
+var serverFeatures = map[string]bool{
+	FeatureAck:   true,
+	FeatureAudit: true,
+}
+
+/**
+Exchange the hello and welcome messages with the node,
+and refuse the node with the close code if the handshake fails.
+
+The node which offers no subprotocol is regarded as the legacy node
+which does not send the hello message.
+*/
+func Handshake(conn *websocket.Conn) (*Hello, error) {
+	if conn.Subprotocol() == "" {
+		return legacyHello(), nil
+	}
+
+	hello, err := readHello(conn)
+	if err != nil {
+		refuse(conn, CloseBadHandshake, err.Error())
+		return nil, ErrBadHandshake
+	}
+
+	if hello.Protocol < MinProtocolVersion || hello.Protocol > ProtocolVersion {
+		reason := fmt.Sprintf("protocol %d is not supported, use %d to %d", hello.Protocol, MinProtocolVersion, ProtocolVersion)
+		refuse(conn, CloseUnsupportedProtocol, reason)
+		return nil, ErrUnsupportedProtocol
+	}
+
+	// enable the features which both sides support
+	hello.enabled = make(map[string]bool)
+	for _, feature := range hello.Features {
+		if serverFeatures[feature] {
+			hello.enabled[feature] = true
+		}
+	}
+	if conn.Subprotocol() == frame.Subprotocol {
+		hello.enabled[FeatureBinary] = true
+	}
+
+	msg := &DataMsg{Type: welcomeType, Contents: &welcome{Protocol: hello.Protocol, Features: hello.EnabledFeatures()}}
+	_ = conn.SetWriteDeadline(time.Now().Add(msgSendWait))
+	if err := conn.WriteJSON(msg); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	return hello, nil
+}
+
+/**
+Read the hello message within the time limit.
+*/
+func readHello(conn *websocket.Conn) (*Hello, error) {
+	conn.SetReadLimit(maxHelloSize)
+	_ = conn.SetReadDeadline(time.Now().Add(helloWait))
+	defer func() {
+		_ = conn.SetReadDeadline(time.Time{})
+	}()
+
+	messageType, data, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	if messageType != websocket.TextMessage {
+		return nil, errors.New("the hello message must be a text message")
+	}
+
+	msg := &struct {
+		Type     string          `json:"type"`
+		Contents json.RawMessage `json:"contents"`
+	}{}
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+
+	if msg.Type != helloType {
+		return nil, fmt.Errorf("expected the hello message but received %q", msg.Type)
+	}
+
+	hello := &Hello{}
+	if err := json.Unmarshal(msg.Contents, hello); err != nil {
+		return nil, err
+	}
+
+	return hello, nil
+}
+
+/**
+Close the connection with the close code and the reason.
+*/
+func refuse(conn *websocket.Conn, code int, reason string) {
+	message := websocket.FormatCloseMessage(code, reason)
+	_ = conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(msgSendWait))
+	_ = conn.Close()
+}
+
+/**
+Hello of the legacy node which speaks the json protocol without the handshake.
+No feature is enabled, because the legacy protocol has no message for them.
+*/
+func legacyHello() *Hello {
+	return &Hello{
+		Features: []string{},
+		enabled:  make(map[string]bool),
+	}
+}
+
+/**
+Return the features which are enabled for this connection.
+*/
+func (hello *Hello) EnabledFeatures() []string {
+	features := make([]string, 0, len(hello.enabled))
+	for feature := range hello.enabled {
+		features = append(features, feature)
+	}
+
+	return features
+}
+
+/**
+Record the hello of the node on the node model.
+*/
+func RecordHello(nodeModel *model.Node, hello *Hello) error {
+	now := time.Now()
+
+	nodeModel.ProtocolVersion = hello.Protocol
+	nodeModel.SoftwareVersion = hello.Software
+	nodeModel.Features = strings.Join(hello.Features, ",")
+	nodeModel.DeclaredStorage = hello.Storage
+	nodeModel.HelloAt = &now
+
+	return database.Conn().
+		Model(&model.Node{}).
+		Where("machine_id = ?", nodeModel.MachineID).
+		Updates(map[string]interface{}{
+			"protocol_version": nodeModel.ProtocolVersion,
+			"software_version": nodeModel.SoftwareVersion,
+			"features":         nodeModel.Features,
+			"declared_storage": nodeModel.DeclaredStorage,
+			"hello_at":         nodeModel.HelloAt,
+		}).
+		Error
+}
@@ -0,0 +1,137 @@
+package spool
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/team836/clowd-storage/pkg/frame"
+)
+
+func TestHandshake(t *testing.T) {
+	tests := []struct {
+		name         string
+		subprotocols []string
+		hello        string // json message which the node sends first
+		wantErr      error
+		wantCode     int      // close code which the node receives when refused
+		wantFeatures []string // enabled features
+	}{
+		{
+			name:         "legacy node without subprotocol",
+			wantFeatures: []string{},
+		},
+		{
+			name:         "feature intersection",
+			subprotocols: []string{frame.JSONSubprotocol},
+			hello:        `{"type":"hello","contents":{"protocol":1,"features":["ack","audit","direct","unknown"]}}`,
+			wantFeatures: []string{FeatureAck, FeatureAudit},
+		},
+		{
+			name:         "binary by subprotocol",
+			subprotocols: []string{frame.Subprotocol},
+			hello:        `{"type":"hello","contents":{"protocol":1,"features":["ack"]}}`,
+			wantFeatures: []string{FeatureAck, FeatureBinary},
+		},
+		{
+			name:         "no common feature",
+			subprotocols: []string{frame.JSONSubprotocol},
+			hello:        `{"type":"hello","contents":{"protocol":1,"features":["compression"]}}`,
+			wantFeatures: []string{},
+		},
+		{
+			name:         "too old protocol",
+			subprotocols: []string{frame.JSONSubprotocol},
+			hello:        `{"type":"hello","contents":{"protocol":0}}`,
+			wantErr:      ErrUnsupportedProtocol,
+			wantCode:     CloseUnsupportedProtocol,
+		},
+		{
+			name:         "too new protocol",
+			subprotocols: []string{frame.JSONSubprotocol},
+			hello:        `{"type":"hello","contents":{"protocol":2}}`,
+			wantErr:      ErrUnsupportedProtocol,
+			wantCode:     CloseUnsupportedProtocol,
+		},
+		{
+			name:         "other message than hello",
+			subprotocols: []string{frame.JSONSubprotocol},
+			hello:        `{"type":"save","contents":{}}`,
+			wantErr:      ErrBadHandshake,
+			wantCode:     CloseBadHandshake,
+		},
+		{
+			name:         "malformed hello",
+			subprotocols: []string{frame.JSONSubprotocol},
+			hello:        `{"type":"hello","contents":`,
+			wantErr:      ErrBadHandshake,
+			wantCode:     CloseBadHandshake,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			serverConn, nodeConn, closeConns := newTestConns(t, test.subprotocols)
+			defer closeConns()
+
+			if test.hello != "" {
+				if err := nodeConn.WriteMessage(websocket.TextMessage, []byte(test.hello)); err != nil {
+					t.Fatalf("WriteMessage() error = %v", err)
+				}
+			}
+
+			hello, err := Handshake(serverConn)
+			if err != test.wantErr {
+				t.Fatalf("Handshake() error = %v, want %v", err, test.wantErr)
+			}
+
+			if test.wantErr != nil {
+				_, _, err := nodeConn.ReadMessage()
+				if !websocket.IsCloseError(err, test.wantCode) {
+					t.Errorf("node read error = %v, want close code %d", err, test.wantCode)
+				}
+				return
+			}
+
+			features := hello.EnabledFeatures()
+			sort.Strings(features)
+			if !reflect.DeepEqual(features, test.wantFeatures) {
+				t.Errorf("EnabledFeatures() = %v, want %v", features, test.wantFeatures)
+			}
+
+			// the legacy node is not answered
+			if test.hello == "" {
+				return
+			}
+
+			msg := &struct {
+				Type     string   `json:"type"`
+				Contents *welcome `json:"contents"`
+			}{}
+			if err := nodeConn.ReadJSON(msg); err != nil {
+				t.Fatalf("ReadJSON() error = %v", err)
+			}
+
+			welcomed := msg.Contents.Features
+			sort.Strings(welcomed)
+			if msg.Type != welcomeType || !reflect.DeepEqual(welcomed, test.wantFeatures) {
+				t.Errorf("welcome = %s %v, want %s %v", msg.Type, welcomed, welcomeType, test.wantFeatures)
+			}
+		})
+	}
+}
+
+func TestLegacyHelloEnablesNothing(t *testing.T) {
+	hello := legacyHello()
+
+	for feature := range serverFeatures {
+		if hello.enabled[feature] {
+			t.Errorf("legacy hello enables %s", feature)
+		}
+	}
+
+	if features := hello.EnabledFeatures(); len(features) != 0 {
+		t.Errorf("EnabledFeatures() = %v, want none", features)
+	}
+}
@@ -0,0 +1,61 @@
+package spool
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+/**
+Ping the node periodically until the connection is closed,
+so the status of the node is always fresh without pinging on demand.
+The first ping is sent immediately to fill the status of the new connection.
+*/
+func (node *ActiveNode) heartbeat() {
+	for {
+		node.ping()
+
+		timer := time.NewTimer(heartbeatDelay())
+		select {
+		case <-node.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+/**
+Return the delay to the next ping.
+The delay is spread randomly by the jitter, so the nodes are not pinged all at once.
+*/
+func heartbeatDelay() time.Duration {
+	interval := viper.GetDuration("HEARTBEAT.INTERVAL")
+	jitter := viper.GetFloat64("HEARTBEAT.JITTER")
+
+	// uniformly distributed in [interval*(1-jitter), interval*(1+jitter)]
+	ratio := 1 + jitter*(2*rand.Float64()-1)
+
+	return time.Duration(float64(interval) * ratio)
+}
+
+/**
+Check whether if the status of the node is not refreshed for a while.
+*/
+func (node *ActiveNode) isStale(now time.Time) bool {
+	node.statusLock.Lock()
+	defer node.statusLock.Unlock()
+
+	return now.After(node.Status.lastCheckedAt.Add(viper.GetDuration("HEARTBEAT.STALE_AFTER")))
+}
+
+/**
+Copy the status of the node and its available space at this moment.
+*/
+func (node *ActiveNode) statusSnapshot(now time.Time) (Status, uint64) {
+	node.statusLock.Lock()
+	defer node.statusLock.Unlock()
+
+	return *node.Status, node.available(now)
+}
@@ -0,0 +1,389 @@
+package spool
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/team836/clowd-storage/pkg/frame"
+	"github.com/team836/clowd-storage/pkg/logger"
+)
+
+/**
+Multiplexing of the operations on one websocket connection.
+
+Every request has the correlation id. The json request carries it as `id` field,
+the binary frame carries it as request id, and the ping carries it as payload.
+The node answers with the same id, so several operations can be in flight at once.
+
+The legacy node which doesn't know the id answers the json requests in order.
+So the json response without id is routed to the oldest json request (FIFO).
+*/
+
+var (
+	errConnectionClosed = errors.New("the websocket connection is closed")
+	errResponseTimeout  = errors.New("the node doesn't respond in time")
+)
+
+/**
+Response of the node for a request.
+*/
+type response struct {
+	// contents of the json response
+	payload json.RawMessage
+
+	// binary response
+	frame *frame.Frame
+}
+
+/**
+Request which waits for the responses.
+*/
+type call struct {
+	id uint32
+
+	// responses routed by the reader
+	// It is buffered by the count of expected responses, and closed when the connection is closed.
+	responses chan *response
+}
+
+/**
+Json response of the node which knows the correlation id.
+*/
+type responseMsg struct {
+	ID       uint32          `json:"id"`
+	Contents json.RawMessage `json:"contents"`
+}
+
+/**
+Issue new correlation id.
+*/
+func (node *ActiveNode) nextID() uint32 {
+	node.callsLock.Lock()
+	defer node.callsLock.Unlock()
+
+	node.lastID++
+	if node.lastID == 0 { // zero means no id
+		node.lastID++
+	}
+
+	return node.lastID
+}
+
+/**
+Register the call which waits for the count of responses.
+If the call is answered in order by the legacy node, it is queued for FIFO routing.
+*/
+func (node *ActiveNode) register(id uint32, expected int, inOrder bool) *call {
+	node.callsLock.Lock()
+	defer node.callsLock.Unlock()
+
+	c := &call{id: id, responses: make(chan *response, expected)}
+	node.calls[id] = c
+	if inOrder {
+		node.fifo = append(node.fifo, id)
+	}
+
+	return c
+}
+
+/**
+Remove the call which is finished or given up.
+*/
+func (node *ActiveNode) unregister(c *call) {
+	node.callsLock.Lock()
+	defer node.callsLock.Unlock()
+
+	delete(node.calls, c.id)
+	node.removeFromFIFO(c.id)
+}
+
+/**
+Remove the id from the FIFO queue.
+SHOULD be called with the calls lock.
+*/
+func (node *ActiveNode) removeFromFIFO(id uint32) {
+	for idx, queued := range node.fifo {
+		if queued == id {
+			node.fifo = append(node.fifo[:idx], node.fifo[idx+1:]...)
+			return
+		}
+	}
+}
+
+/**
+Route the response to the call.
+The response with zero id is routed to the oldest call in the FIFO queue.
+*/
+func (node *ActiveNode) route(id uint32, resp *response) {
+	node.callsLock.Lock()
+	defer node.callsLock.Unlock()
+
+	if id == 0 {
+		if len(node.fifo) == 0 {
+			logger.File().Infof("Unexpected response from node(%s)", node.Model.MachineID)
+			return
+		}
+
+		id = node.fifo[0]
+	} else {
+		// the node knows the correlation id
+		node.multiplexed = true
+	}
+
+	c, ok := node.calls[id]
+	if !ok {
+		// the call is already given up
+		return
+	}
+
+	select {
+	case c.responses <- resp:
+	default: // more responses than expected
+		return
+	}
+
+	// the call is answered, so the next response without id goes to the next call
+	if len(c.responses) == cap(c.responses) {
+		node.removeFromFIFO(id)
+	}
+}
+
+/**
+Wait for the count of responses of the call until the timeout.
+*/
+func (node *ActiveNode) await(c *call, timeout time.Duration) ([]*response, error) {
+	return node.awaitContext(context.Background(), c, timeout)
+}
+
+/**
+Wait for the count of responses of the call until the timeout or the context is done.
+
+When the context is done, the call is given up and its late responses are dropped.
+But the call answered in order by the legacy node keeps waiting in background,
+because its late response would be routed to the next call.
+*/
+func (node *ActiveNode) awaitContext(ctx context.Context, c *call, timeout time.Duration) ([]*response, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	responses := make([]*response, 0, cap(c.responses))
+	for len(responses) < cap(c.responses) {
+		select {
+		case resp, ok := <-c.responses:
+			if !ok {
+				node.unregister(c)
+				return nil, errConnectionClosed
+			}
+
+			responses = append(responses, resp)
+		case <-timer.C:
+			node.unregister(c)
+
+			// the late response of the legacy node will be routed to the another call,
+			// so the connection cannot be used anymore
+			if !node.isMultiplexed() {
+				node.close()
+			}
+
+			return nil, errResponseTimeout
+		case <-ctx.Done():
+			if !node.isMultiplexed() && node.isQueued(c) {
+				go node.await(c, timeout)
+			} else {
+				node.unregister(c)
+			}
+
+			return nil, ctx.Err()
+		}
+	}
+
+	node.unregister(c)
+
+	return responses, nil
+}
+
+/**
+Whether if the call waits for the response without id in the FIFO queue.
+*/
+func (node *ActiveNode) isQueued(c *call) bool {
+	node.callsLock.Lock()
+	defer node.callsLock.Unlock()
+
+	for _, queued := range node.fifo {
+		if queued == c.id {
+			return true
+		}
+	}
+
+	return false
+}
+
+/**
+Whether if the node has answered with the correlation id.
+*/
+func (node *ActiveNode) isMultiplexed() bool {
+	node.callsLock.Lock()
+	defer node.callsLock.Unlock()
+
+	return node.multiplexed
+}
+
+/**
+Read every messages from the node and route them to the calls.
+When the connection is closed, every waiting calls are failed.
+*/
+func (node *ActiveNode) readLoop() {
+	defer func() {
+		node.close()
+
+		node.callsLock.Lock()
+		for id, c := range node.calls {
+			close(c.responses)
+			delete(node.calls, id)
+		}
+		node.fifo = nil
+		node.callsLock.Unlock()
+
+		close(node.done)
+	}()
+
+	node.conn.SetReadLimit(maxLoadSize)
+
+	for {
+		messageType, data, err := node.conn.ReadMessage()
+		if err != nil {
+			logger.File().Infof("Error reading from node, %s", err)
+			return
+		}
+
+		switch messageType {
+		case websocket.BinaryMessage:
+			received, err := frame.Read(bytes.NewReader(data), maxLoadSize)
+			if err != nil {
+				logger.File().Infof("Error reading frame from node, %s", err)
+				return
+			}
+
+			node.route(received.RequestID, &response{frame: received})
+		case websocket.TextMessage:
+			// the legacy response is not the message with id, or not even an object
+			msg := &responseMsg{}
+			if err := json.Unmarshal(data, msg); err != nil || msg.ID == 0 {
+				node.route(0, &response{payload: data})
+				continue
+			}
+
+			node.route(msg.ID, &response{payload: msg.Contents})
+		}
+	}
+}
+
+/**
+Write the json message to the node.
+The request which expects responses SHOULD be registered by the `register` callback
+while the write lock is held, so the FIFO order is same as the order on the wire.
+*/
+func (node *ActiveNode) writeJSON(msg *DataMsg, timeout time.Duration) error {
+	node.writeLock.Lock()
+	defer node.writeLock.Unlock()
+
+	_ = node.conn.SetWriteDeadline(time.Now().Add(timeout))
+	if err := node.conn.WriteJSON(msg); err != nil {
+		node.close()
+		return err
+	}
+
+	return nil
+}
+
+/**
+Send the json request and register the call for its response atomically.
+*/
+func (node *ActiveNode) requestJSON(msgType string, contents interface{}, timeout time.Duration) (*call, error) {
+	node.writeLock.Lock()
+	defer node.writeLock.Unlock()
+
+	id := node.nextID()
+	c := node.register(id, 1, true)
+
+	_ = node.conn.SetWriteDeadline(time.Now().Add(timeout))
+	if err := node.conn.WriteJSON(&DataMsg{ID: id, Type: msgType, Contents: contents}); err != nil {
+		node.unregister(c)
+		node.close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+/**
+Send the ping with the correlation id and register the call for its pong atomically.
+The node answers the pong as json message.
+*/
+func (node *ActiveNode) requestPing(timeout time.Duration) (*call, error) {
+	node.writeLock.Lock()
+	defer node.writeLock.Unlock()
+
+	id := node.nextID()
+	c := node.register(id, 1, true)
+
+	payload := []byte(strconv.FormatUint(uint64(id), 10))
+	if err := node.conn.WriteControl(websocket.PingMessage, payload, time.Now().Add(timeout)); err != nil {
+		node.unregister(c)
+		node.close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+/**
+Write the binary frames to the node.
+*/
+func (node *ActiveNode) writeFrames(frames []*frame.Frame, timeout time.Duration) error {
+	node.writeLock.Lock()
+	defer node.writeLock.Unlock()
+
+	_ = node.conn.SetWriteDeadline(time.Now().Add(timeout))
+	for _, f := range frames {
+		if err := node.writeFrame(f); err != nil {
+			node.close()
+			return err
+		}
+	}
+
+	return nil
+}
+
+/**
+Write the frame as a websocket binary message.
+SHOULD be called with the write lock.
+*/
+func (node *ActiveNode) writeFrame(f *frame.Frame) error {
+	w, err := node.conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+
+	if err := frame.Write(w, f); err != nil {
+		_ = w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+/**
+Close the websocket connection.
+The reader stops by the closed connection and the node is unregistered.
+*/
+func (node *ActiveNode) close() {
+	node.closeOnce.Do(func() {
+		_ = node.conn.Close()
+	})
+}
@@ -0,0 +1,262 @@
+package spool
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/team836/clowd-storage/internal/model"
+	"github.com/team836/clowd-storage/pkg/frame"
+)
+
+/**
+Open the websocket connection to the test server
+and return the server side and the node side of it with the function closing them.
+*/
+func newTestConns(t *testing.T, subprotocols []string) (*websocket.Conn, *websocket.Conn, func()) {
+	t.Helper()
+
+	accepted := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upgrader := websocket.Upgrader{Subprotocols: []string{frame.Subprotocol, frame.JSONSubprotocol}}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("Upgrade() error = %v", err)
+			return
+		}
+
+		accepted <- conn
+	}))
+
+	dialer := &websocket.Dialer{Subprotocols: subprotocols}
+	nodeConn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		server.Close()
+		t.Fatalf("Dial() error = %v", err)
+	}
+
+	serverConn := <-accepted
+
+	return serverConn, nodeConn, func() {
+		_ = nodeConn.Close()
+		_ = serverConn.Close()
+		server.Close()
+	}
+}
+
+func newTestMuxNode(conn *websocket.Conn) *ActiveNode {
+	return &ActiveNode{
+		Model: &model.Node{MachineID: "node"},
+		conn:  conn,
+		calls: make(map[uint32]*call),
+		done:  make(chan struct{}),
+	}
+}
+
+func TestRoute(t *testing.T) {
+	tests := []struct {
+		name            string
+		inOrder         []bool   // whether if each call is answered in order, the call ids start from 1
+		routes          []uint32 // id of each response, zero is the response without id
+		want            map[uint32]int
+		wantMultiplexed bool
+	}{
+		{"fifo", []bool{true, true}, []uint32{0, 0}, map[uint32]int{1: 1, 2: 1}, false},
+		{"correlation id out of order", []bool{true, true}, []uint32{2, 1}, map[uint32]int{1: 1, 2: 1}, true},
+		{"answered call leaves the fifo", []bool{true, true}, []uint32{1, 0}, map[uint32]int{1: 1, 2: 1}, true},
+		{"fifo skips the call not in order", []bool{false, true}, []uint32{0}, map[uint32]int{2: 1}, false},
+		{"response without any call", nil, []uint32{0}, map[uint32]int{}, false},
+		{"response of the given up call", []bool{true}, []uint32{9}, map[uint32]int{1: 0}, true},
+		{"more responses than expected", []bool{true}, []uint32{1, 1, 0}, map[uint32]int{1: 1}, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := newTestMuxNode(nil)
+
+			calls := make(map[uint32]*call)
+			for _, inOrder := range test.inOrder {
+				id := node.nextID()
+				calls[id] = node.register(id, 1, inOrder)
+			}
+
+			for _, id := range test.routes {
+				node.route(id, &response{payload: json.RawMessage(`{}`)})
+			}
+
+			for id, c := range calls {
+				if got := len(c.responses); got != test.want[id] {
+					t.Errorf("call %d has %d responses, want %d", id, got, test.want[id])
+				}
+			}
+
+			if got := node.isMultiplexed(); got != test.wantMultiplexed {
+				t.Errorf("isMultiplexed() = %v, want %v", got, test.wantMultiplexed)
+			}
+		})
+	}
+}
+
+func TestAwaitTimeout(t *testing.T) {
+	tests := []struct {
+		name        string
+		multiplexed bool
+		wantClosed  bool
+	}{
+		{"multiplexed node keeps the connection", true, false},
+		{"legacy node closes the connection", false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			serverConn, nodeConn, closeConns := newTestConns(t, nil)
+			defer closeConns()
+
+			node := newTestMuxNode(serverConn)
+			node.multiplexed = test.multiplexed
+
+			c := node.register(node.nextID(), 1, true)
+			if _, err := node.await(c, 10*time.Millisecond); err != errResponseTimeout {
+				t.Fatalf("await() error = %v, want %v", err, errResponseTimeout)
+			}
+
+			if node.isQueued(c) || node.calls[c.id] != nil {
+				t.Errorf("the timed out call is still registered")
+			}
+
+			// the node side reads the close or times out on the open connection
+			_ = nodeConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			_, _, err := nodeConn.ReadMessage()
+			closed := err != nil && !isTimeout(err)
+			if closed != test.wantClosed {
+				t.Errorf("connection closed = %v, want %v (read error = %v)", closed, test.wantClosed, err)
+			}
+		})
+	}
+}
+
+func isTimeout(err error) bool {
+	timeout, ok := err.(interface{ Timeout() bool })
+	return ok && timeout.Timeout()
+}
+
+func TestAwaitContextCanceled(t *testing.T) {
+	tests := []struct {
+		name        string
+		multiplexed bool
+		inOrder     bool
+		wantQueued  bool
+	}{
+		{"legacy call keeps its place in the fifo", false, true, true},
+		{"multiplexed call is given up", true, true, false},
+		{"call not in order is given up", false, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := newTestMuxNode(nil)
+			node.multiplexed = test.multiplexed
+
+			c := node.register(node.nextID(), 1, test.inOrder)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			if _, err := node.awaitContext(ctx, c, time.Minute); err != context.Canceled {
+				t.Fatalf("awaitContext() error = %v, want %v", err, context.Canceled)
+			}
+
+			if got := node.isQueued(c); got != test.wantQueued {
+				t.Errorf("isQueued() = %v, want %v", got, test.wantQueued)
+			}
+
+			// the late response finishes the call waiting in background
+			node.route(0, &response{payload: json.RawMessage(`{}`)})
+		})
+	}
+}
+
+func TestAwaitConnectionClosed(t *testing.T) {
+	node := newTestMuxNode(nil)
+	c := node.register(node.nextID(), 2, false)
+
+	node.route(c.id, &response{payload: json.RawMessage(`{}`)})
+	close(c.responses)
+
+	if _, err := node.await(c, time.Minute); err != errConnectionClosed {
+		t.Errorf("await() error = %v, want %v", err, errConnectionClosed)
+	}
+}
+
+func TestReadLoop(t *testing.T) {
+	serverConn, nodeConn, closeConns := newTestConns(t, nil)
+	defer closeConns()
+
+	node := newTestMuxNode(serverConn)
+	go node.readLoop()
+
+	legacy := node.register(node.nextID(), 1, true)
+	byID := node.register(node.nextID(), 1, true)
+	byFrame := node.register(node.nextID(), 1, false)
+	unanswered := node.register(node.nextID(), 1, false)
+
+	// answer in the reverse order
+	binary := &strings.Builder{}
+	if err := frame.Write(binary, &frame.Frame{Op: frame.OpShard, RequestID: byFrame.id, Name: "shard"}); err != nil {
+		t.Fatalf("frame.Write() error = %v", err)
+	}
+	messages := []struct {
+		messageType int
+		data        string
+	}{
+		{websocket.BinaryMessage, binary.String()},
+		{websocket.TextMessage, `{"id":2,"contents":{"by":"id"}}`},
+		{websocket.TextMessage, `{"by":"order"}`},
+	}
+	for _, msg := range messages {
+		if err := nodeConn.WriteMessage(msg.messageType, []byte(msg.data)); err != nil {
+			t.Fatalf("WriteMessage() error = %v", err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		call *call
+		want string
+	}{
+		{"binary frame by request id", byFrame, "shard"},
+		{"json by correlation id", byID, `{"by":"id"}`},
+		{"json without id by order", legacy, `{"by":"order"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			responses, err := node.await(test.call, time.Second)
+			if err != nil {
+				t.Fatalf("await() error = %v", err)
+			}
+
+			got := string(responses[0].payload)
+			if responses[0].frame != nil {
+				got = responses[0].frame.Name
+			}
+
+			if got != test.want {
+				t.Errorf("response = %s, want %s", got, test.want)
+			}
+		})
+	}
+
+	// the waiting call fails when the connection is closed
+	_ = nodeConn.Close()
+	if _, err := node.await(unanswered, time.Second); err != errConnectionClosed {
+		t.Errorf("await() error = %v, want %v", err, errConnectionClosed)
+	}
+
+	<-node.done
+}
@@ -0,0 +1,153 @@
+package spool
+
+import (
+	"container/ring"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+const (
+	// uptime which is regarded as fully stable
+	stableUptime = 24 * time.Hour
+
+	// smoothing factor of the failure rate
+	// The bigger factor reflects recent operations more.
+	failureRateFactor = 0.1
+)
+
+/**
+Weights of each metric for the node score.
+*/
+type selectionWeights struct {
+	rtt        float64
+	bandwidth  float64
+	capacity   float64
+	uptime     float64
+	failure    float64
+	reputation float64
+}
+
+/**
+Load the node selection weights from the config.
+*/
+func loadSelectionWeights() *selectionWeights {
+	return &selectionWeights{
+		rtt:        viper.GetFloat64("NODE_SELECTION.WEIGHT.RTT"),
+		bandwidth:  viper.GetFloat64("NODE_SELECTION.WEIGHT.BANDWIDTH"),
+		capacity:   viper.GetFloat64("NODE_SELECTION.WEIGHT.CAPACITY"),
+		uptime:     viper.GetFloat64("NODE_SELECTION.WEIGHT.UPTIME"),
+		failure:    viper.GetFloat64("NODE_SELECTION.WEIGHT.FAILURE"),
+		reputation: viper.GetFloat64("NODE_SELECTION.WEIGHT.REPUTATION"),
+	}
+}
+
+/**
+Rank the nodes by weighted score in descending order.
+
+Each metric is normalized to [0, 1] among the given nodes,
+so the score is relative to the other candidates.
+*/
+func rankNodes(nodes []*ActiveNode) []*ActiveNode {
+	if len(nodes) == 0 {
+		return nodes
+	}
+
+	weights := loadSelectionWeights()
+	now := time.Now()
+
+	// rank by the statuses at this moment, they are refreshed by the heartbeats meanwhile
+	// The capacity is the available space which the reservation allows,
+	// so the node which cannot take the shard is not ranked high.
+	statuses := make(map[*ActiveNode]Status, len(nodes))
+	availables := make(map[*ActiveNode]uint64, len(nodes))
+	for _, node := range nodes {
+		statuses[node], availables[node] = node.statusSnapshot(now)
+	}
+
+	// find the range of each metric
+	minRTT, maxRTT := math.MaxFloat64, 0.0
+	maxBandwidth, maxCapacity := 0.0, 0.0
+	for node, status := range statuses {
+		if latency := status.Latency(); latency != unmeasuredLatency {
+			minRTT = math.Min(minRTT, float64(latency))
+			maxRTT = math.Max(maxRTT, float64(latency))
+		}
+		maxBandwidth = math.Max(maxBandwidth, float64(status.Bandwidth))
+		maxCapacity = math.Max(maxCapacity, float64(availables[node]))
+	}
+
+	// calculate the score of every nodes
+	scores := make(map[*ActiveNode]float64, len(nodes))
+	for _, node := range nodes {
+		status := statuses[node]
+
+		// lower rtt is better, and the node which is not measured yet is the worst
+		rttScore := 1.0
+		if latency := status.Latency(); latency == unmeasuredLatency {
+			rttScore = 0
+		} else if maxRTT > minRTT {
+			rttScore = (maxRTT - float64(latency)) / (maxRTT - minRTT)
+		}
+
+		bandwidthScore := normalize(float64(status.Bandwidth), maxBandwidth)
+		capacityScore := normalize(float64(availables[node]), maxCapacity)
+
+		// longer uptime is better until it reaches the stable uptime
+		uptimeScore := math.Min(now.Sub(node.connectedAt).Seconds()/stableUptime.Seconds(), 1)
+
+		// lower failure rate is better
+		failureScore := 1 - status.failureRate
+
+		scores[node] = weights.rtt*rttScore +
+			weights.bandwidth*bandwidthScore +
+			weights.capacity*capacityScore +
+			weights.uptime*uptimeScore +
+			weights.failure*failureScore +
+			weights.reputation*status.reputation
+	}
+
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return scores[nodes[i]] > scores[nodes[j]]
+	})
+
+	return nodes
+}
+
+/**
+Normalize the value by maximum value.
+*/
+func normalize(value, max float64) float64 {
+	if max <= 0 {
+		return 0
+	}
+
+	return value / max
+}
+
+/**
+Update the failure rate of the node by the result of recent operation.
+*/
+func (status *Status) recordResult(failed bool) {
+	var sample float64
+	if failed {
+		sample = 1
+	}
+
+	status.failureRate = (1-failureRateFactor)*status.failureRate + failureRateFactor*sample
+}
+
+/**
+Convert slice to ring keeping the order.
+*/
+func sliceToRing(nodes []*ActiveNode) *ring.Ring {
+	r := ring.New(len(nodes))
+	for _, node := range nodes {
+		r.Value = node
+		r = r.Next()
+	}
+
+	return r
+}
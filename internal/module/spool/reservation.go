@@ -0,0 +1,95 @@
+package spool
+
+import (
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+/**
+Space of the node which is reserved for the shard until the node acknowledges it.
+*/
+type reservation struct {
+	size      uint64
+	expiresAt time.Time
+}
+
+/**
+Reserve the space for the shard if the node has enough available space.
+Return whether if the space is reserved.
+
+The reservation is released when it is expired,
+so the space of the failed save is returned to the node eventually.
+*/
+func (node *ActiveNode) Reserve(shardName string, size uint64) bool {
+	node.statusLock.Lock()
+	defer node.statusLock.Unlock()
+
+	now := time.Now()
+
+	// the shard which is reserved again is replaced
+	delete(node.reservations, shardName)
+
+	if node.available(now) < size {
+		return false
+	}
+
+	node.reservations[shardName] = &reservation{
+		size:      size,
+		expiresAt: now.Add(viper.GetDuration("RESERVATION.TTL")),
+	}
+
+	return true
+}
+
+/**
+Convert the reservation of the acknowledged shard to the committed usage.
+The reported free space is predicted until the next heartbeat reports the real one.
+If the reservation is already expired, the usage is reloaded by the next heartbeat.
+*/
+func (node *ActiveNode) Commit(shardName string) {
+	node.statusLock.Lock()
+	defer node.statusLock.Unlock()
+
+	r, ok := node.reservations[shardName]
+	if !ok {
+		return
+	}
+	delete(node.reservations, shardName)
+
+	if node.Status.Capacity > r.size {
+		node.Status.Capacity -= r.size
+	} else {
+		node.Status.Capacity = 0
+	}
+
+	node.Status.assigned += r.size
+}
+
+/**
+Release the reservation of the shard which is not saved on the node.
+*/
+func (node *ActiveNode) Release(shardName string) {
+	node.statusLock.Lock()
+	defer node.statusLock.Unlock()
+
+	delete(node.reservations, shardName)
+}
+
+/**
+Sum the bytes of the reservations which are not expired, and drop the expired ones.
+You SHOULD use this function with the `statusLock`.
+*/
+func (node *ActiveNode) reserved(now time.Time) uint64 {
+	var total uint64 = 0
+	for name, r := range node.reservations {
+		if now.After(r.expiresAt) {
+			delete(node.reservations, name)
+			continue
+		}
+
+		total += r.size
+	}
+
+	return total
+}
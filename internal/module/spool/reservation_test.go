@@ -0,0 +1,198 @@
+package spool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/team836/clowd-storage/internal/model"
+)
+
+const gib = 1 << 30
+
+func newTestNode(capacity, assigned uint64, allocation uint16) *ActiveNode {
+	node := &ActiveNode{
+		Model:        &model.Node{MachineID: "node", MaxCapacity: allocation},
+		Status:       &Status{Capacity: capacity, assigned: assigned},
+		reservations: make(map[string]*reservation),
+	}
+
+	if allocation != 0 {
+		declaredAt := time.Now()
+		node.Model.CapacityDeclaredAt = &declaredAt
+	}
+
+	return node
+}
+
+type ledgerStep struct {
+	op   string // reserve, commit or release
+	name string
+	size uint64
+	want bool // result of the reserve
+}
+
+func TestReservationLedger(t *testing.T) {
+	viper.Set("RESERVATION.TTL", time.Minute)
+
+	tests := []struct {
+		name          string
+		capacity      uint64
+		assigned      uint64
+		allocation    uint16 // GiB, zero means not declared
+		steps         []ledgerStep
+		wantAvailable uint64
+		wantCapacity  uint64
+		wantAssigned  uint64
+	}{
+		{
+			name:     "reserve within capacity",
+			capacity: 100,
+			steps: []ledgerStep{
+				{op: "reserve", name: "a", size: 60, want: true},
+				{op: "reserve", name: "b", size: 40, want: true},
+			},
+			wantAvailable: 0,
+			wantCapacity:  100,
+		},
+		{
+			name:     "reserve over the reserved space",
+			capacity: 100,
+			steps: []ledgerStep{
+				{op: "reserve", name: "a", size: 60, want: true},
+				{op: "reserve", name: "b", size: 41, want: false},
+			},
+			wantAvailable: 40,
+			wantCapacity:  100,
+		},
+		{
+			name:     "reserve again replaces",
+			capacity: 100,
+			steps: []ledgerStep{
+				{op: "reserve", name: "a", size: 60, want: true},
+				{op: "reserve", name: "a", size: 90, want: true},
+			},
+			wantAvailable: 10,
+			wantCapacity:  100,
+		},
+		{
+			name:     "commit converts to usage",
+			capacity: 100,
+			assigned: 5,
+			steps: []ledgerStep{
+				{op: "reserve", name: "a", size: 60, want: true},
+				{op: "commit", name: "a"},
+			},
+			wantAvailable: 40,
+			wantCapacity:  40,
+			wantAssigned:  65,
+		},
+		{
+			name:     "commit without reservation",
+			capacity: 100,
+			steps: []ledgerStep{
+				{op: "commit", name: "a"},
+			},
+			wantAvailable: 100,
+			wantCapacity:  100,
+		},
+		{
+			name:     "release returns the space",
+			capacity: 100,
+			steps: []ledgerStep{
+				{op: "reserve", name: "a", size: 60, want: true},
+				{op: "release", name: "a"},
+				{op: "reserve", name: "b", size: 100, want: true},
+			},
+			wantAvailable: 0,
+			wantCapacity:  100,
+		},
+		{
+			name:       "allocation limits the free disk",
+			capacity:   10 * gib,
+			assigned:   gib / 2,
+			allocation: 1,
+			steps: []ledgerStep{
+				{op: "reserve", name: "a", size: gib/2 + 1, want: false},
+				{op: "reserve", name: "b", size: gib / 4, want: true},
+			},
+			wantAvailable: gib / 4,
+			wantCapacity:  10 * gib,
+			wantAssigned:  gib / 2,
+		},
+		{
+			name:       "free disk limits the allocation",
+			capacity:   gib / 2,
+			allocation: 2,
+			steps: []ledgerStep{
+				{op: "reserve", name: "a", size: gib/2 + 1, want: false},
+			},
+			wantAvailable: gib / 2,
+			wantCapacity:  gib / 2,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			node := newTestNode(test.capacity, test.assigned, test.allocation)
+
+			for idx, step := range test.steps {
+				switch step.op {
+				case "reserve":
+					if got := node.Reserve(step.name, step.size); got != step.want {
+						t.Fatalf("step %d: Reserve(%s, %d) = %v, want %v", idx, step.name, step.size, got, step.want)
+					}
+				case "commit":
+					node.Commit(step.name)
+				case "release":
+					node.Release(step.name)
+				}
+			}
+
+			if got := node.available(time.Now()); got != test.wantAvailable {
+				t.Errorf("available() = %d, want %d", got, test.wantAvailable)
+			}
+
+			if node.Status.Capacity != test.wantCapacity {
+				t.Errorf("Capacity = %d, want %d", node.Status.Capacity, test.wantCapacity)
+			}
+
+			if node.Status.assigned != test.wantAssigned {
+				t.Errorf("assigned = %d, want %d", node.Status.assigned, test.wantAssigned)
+			}
+		})
+	}
+}
+
+func TestReservationExpiry(t *testing.T) {
+	viper.Set("RESERVATION.TTL", time.Minute)
+
+	node := newTestNode(100, 0, 0)
+	if !node.Reserve("a", 60) {
+		t.Fatalf("Reserve() = false, want true")
+	}
+
+	tests := []struct {
+		name string
+		at   time.Duration
+		want uint64
+	}{
+		{"before expiry", 30 * time.Second, 60},
+		{"after expiry", 2 * time.Minute, 0},
+		{"expired one is dropped", 0, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := node.reserved(time.Now().Add(test.at)); got != test.want {
+				t.Errorf("reserved() = %d, want %d", got, test.want)
+			}
+		})
+	}
+
+	// the expired reservation is not converted to the usage
+	node.Commit("a")
+	if node.Status.Capacity != 100 || node.Status.assigned != 0 {
+		t.Errorf("Commit() of the expired reservation changed the usage")
+	}
+}
@@ -0,0 +1,65 @@
+package spool
+
+import (
+	"math"
+	"time"
+)
+
+/**
+Smoothing factors of the rtt estimation.
+(See https://tools.ietf.org/html/rfc6298 document)
+*/
+const (
+	rttAlpha = 0.125
+
+	rttBeta = 0.25
+)
+
+const (
+	// latency of the node whose rtt is not measured yet
+	// The node is ranked last rather than trusting its self-reported rtt.
+	unmeasuredLatency = time.Duration(math.MaxInt64)
+)
+
+/**
+Update the smoothed rtt and its variation by new rtt sample.
+*/
+func (status *Status) updateRTT(sample time.Duration) {
+	// first measurement
+	if status.SmoothedRTT == 0 {
+		status.SmoothedRTT = sample
+		status.RTTVar = sample / 2
+		return
+	}
+
+	diff := status.SmoothedRTT - sample
+	if diff < 0 {
+		diff = -diff
+	}
+
+	status.RTTVar = time.Duration((1-rttBeta)*float64(status.RTTVar) + rttBeta*float64(diff))
+	status.SmoothedRTT = time.Duration((1-rttAlpha)*float64(status.SmoothedRTT) + rttAlpha*float64(sample))
+}
+
+/**
+Return the latency of the node which the server can trust.
+Only the rtt measured by the server is used,
+and the node which is not measured yet has the unmeasured latency.
+*/
+func (status *Status) Latency() time.Duration {
+	if status.SmoothedRTT == 0 {
+		return unmeasuredLatency
+	}
+
+	return status.SmoothedRTT
+}
+
+/**
+Return the latency of the node at this moment.
+*/
+func (node *ActiveNode) Latency() time.Duration {
+	node.statusLock.Lock()
+	defer node.statusLock.Unlock()
+
+	return node.Status.Latency()
+}
@@ -4,10 +4,9 @@ import (
 	"container/ring"
 	"sync"
 	"time"
-)
 
-const (
-	pingCoolTime = 3 * time.Second
+	"github.com/team836/clowd-storage/internal/model"
+	"github.com/team836/clowd-storage/internal/module/lifecycle"
 )
 
 var (
@@ -16,20 +15,13 @@ var (
 )
 
 type SocketPool struct {
-	// mutex for all nodes' status
-	NodesStatusLock sync.Mutex
-
-	// wait group for checking all ping&pong are done
-	pingWaitGroup sync.WaitGroup
-
-	// registered nodes
-	Nodes map[*ActiveNode]bool
+	// registered nodes indexed by machine id
+	nodes     map[string]*ActiveNode
+	nodesLock sync.RWMutex
 
-	// register requests from the node
-	Register chan *ActiveNode
-
-	// unregister requests from the node
-	Unregister chan *ActiveNode
+	// listeners of the join&leave events
+	listeners     []Listener
+	listenersLock sync.RWMutex
 }
 
 /**
@@ -48,131 +40,156 @@ Create new socket pool.
 */
 func newSocketPool() *SocketPool {
 	pool := &SocketPool{
-		Nodes:      make(map[*ActiveNode]bool),
-		Register:   make(chan *ActiveNode),
-		Unregister: make(chan *ActiveNode),
+		nodes: make(map[string]*ActiveNode),
 	}
 
-	// Run the pool operations concurrently
-	go pool.run()
+	// sync the states of the active nodes
+	lifecycle.Subscribe(pool.onTransition)
 
 	return pool
 }
 
 func (pool *SocketPool) TotalCapacity() uint64 {
 	var cap uint64 = 0
-	for node := range pool.Nodes {
-		cap += node.Status.Capacity
+	for _, node := range pool.Snapshot() {
+		cap += node.Available()
 	}
 
 	return cap
 }
 
+/**
+Return the registered nodes at this moment.
+The returned slice is owned by the caller, so the pool can be changed while iterating it.
+*/
+func (pool *SocketPool) Snapshot() []*ActiveNode {
+	pool.nodesLock.RLock()
+	defer pool.nodesLock.RUnlock()
+
+	nodes := make([]*ActiveNode, 0, len(pool.nodes))
+	for _, node := range pool.nodes {
+		nodes = append(nodes, node)
+	}
+
+	return nodes
+}
+
 /**
 Find active node in the pool by machine id.
 */
 func (pool *SocketPool) FindActiveNode(machineID string) *ActiveNode {
-	for node := range pool.Nodes {
-		if node.Model.MachineID == machineID {
-			return node
-		}
-	}
+	pool.nodesLock.RLock()
+	defer pool.nodesLock.RUnlock()
 
-	return nil
+	return pool.nodes[machineID]
 }
 
 /**
-Send ping concurrently to nodes whose current status is old
-and wait for all pong response.
+Register the node to pool.
+If the node with same machine id is already registered,
+replace it atomically and close the old connection.
+*/
+func (pool *SocketPool) Register(node *ActiveNode) {
+	pool.nodesLock.Lock()
+	old := pool.nodes[node.Model.MachineID]
+	pool.nodes[node.Model.MachineID] = node
+	pool.nodesLock.Unlock()
+
+	if old != nil {
+		// the old connection unregisters itself when its operations are stopped,
+		// but it is not in the pool anymore
+		old.close()
+		pool.notify(&Event{Type: EventLeave, Node: old, Replaced: true})
+	}
+
+	go func() {
+		node.updateLastSeen()
+		node.transit(model.NodeOnline)
+	}()
 
-This function change nodes' status. So you SHOULD use this function with
-the `NodesStatusLock` which is mutex for all nodes' status.
+	// flush deleted shard list
+	go func() {
+		node.Flush <- true
+	}()
+
+	pool.notify(&Event{Type: EventJoin, Node: node})
+}
+
+/**
+Unregister the node from pool and close its connection.
+Nothing is removed if the node was already replaced by the new connection.
 */
-func (pool *SocketPool) CheckAllNodes() {
-	now := time.Now()
-	for node := range pool.Nodes {
-		// check whether if the node's current status is old
-		if now.After(node.Status.lastCheckedAt.Add(pingCoolTime)) {
-			pool.pingWaitGroup.Add(1)
-			node.Ping <- true // try ping
-
-			select {
-			// ping request is buffered
-			// because this node's websocket is currently busy(processing save or load)
-			case <-node.Ping:
-				node.Status.isOld = true
-				pool.pingWaitGroup.Done()
-			// concurrently process ping request
-			default:
-			}
-		}
+func (pool *SocketPool) Unregister(node *ActiveNode) {
+	node.close()
+
+	// the failure rate is saved before the node leaves the pool,
+	// so the next connection finds it either in the pool or in the database
+	if pool.FindActiveNode(node.Model.MachineID) == node {
+		node.saveFailureRate()
+	}
+
+	pool.nodesLock.Lock()
+	current, ok := pool.nodes[node.Model.MachineID]
+	removed := ok && current == node
+	if removed {
+		delete(pool.nodes, node.Model.MachineID)
 	}
+	pool.nodesLock.Unlock()
+
+	// the session belongs to the connection, not to the registry entry
+	go node.closeSession()
 
-	// wait for all ping&pong to finish
-	pool.pingWaitGroup.Wait()
+	if !removed {
+		return
+	}
+
+	go func() {
+		// the timeouts of the lifecycle are measured from the last seen time
+		node.updateLastSeen()
+		node.transit(model.NodeSuspect)
+	}()
+
+	pool.notify(&Event{Type: EventLeave, Node: node})
 }
 
 /**
 Select the nodes to save the files and sort them by node selection algorithm.
+The nodes are ranked by weighted score of rtt, bandwidth, capacity, uptime, failure rate and reputation.
 Return type is ring, which is circular list, because select the nodes until
 all shards are scheduled.
 
 The first return value is the safe nodes that have latest(reliable) status.
 The second return value is the unsafe nodes that have old(unreliable) status.
-
-This function read nodes' status at specific time. So you SHOULD use this function with
-the `NodesStatusLock` which is mutex for all nodes' status.
+The status is kept fresh by the heartbeat of each node, so this function never waits for the nodes.
 */
 func (pool *SocketPool) SelectNodes() (*ring.Ring, *ring.Ring) {
-	safeNodes := make(map[*ActiveNode]bool)
-	unsafeNodes := make(map[*ActiveNode]bool)
+	safeNodes := make([]*ActiveNode, 0)
+	unsafeNodes := make([]*ActiveNode, 0)
 
 	// separate node list by whether status is old or not
-	for node := range pool.Nodes {
-		if node.Status.isOld {
-			unsafeNodes[node] = true
-		} else {
-			safeNodes[node] = true
+	now := time.Now()
+	for _, node := range pool.Snapshot() {
+		// only the online nodes can receive new shards
+		if node.State() != model.NodeOnline {
+			continue
 		}
-	}
-
-	// TODO: implement node selection algorithm
-
-	return mapToRing(safeNodes), mapToRing(unsafeNodes)
-}
-
-/**
-Run the pool operations using non-blocking channels.
 
-register: register the node to pool
-unregister: unregister the node from pool
-*/
-func (pool *SocketPool) run() {
-	for {
-		select {
-		case node := <-pool.Register:
-			pool.Nodes[node] = true
-
-			// flush deleted shard list
-			go func() {
-				node.Flush <- true
-			}()
-		case node := <-pool.Unregister:
-			_ = node.conn.Close()
-			delete(pool.Nodes, node)
+		if node.isStale(now) {
+			unsafeNodes = append(unsafeNodes, node)
+		} else {
+			safeNodes = append(safeNodes, node)
 		}
 	}
+
+	// sort the nodes by node selection algorithm
+	return sliceToRing(rankNodes(safeNodes)), sliceToRing(rankNodes(unsafeNodes))
 }
 
 /**
-Convert map to ring.
+Sync the cached state of the active node with the transition.
 */
-func mapToRing(m map[*ActiveNode]bool) *ring.Ring {
-	r := ring.New(len(m))
-	for key := range m {
-		r.Value = key
-		r = r.Next()
+func (pool *SocketPool) onTransition(machineID string, from, to model.NodeState) {
+	if node := pool.FindActiveNode(machineID); node != nil {
+		node.setState(to)
 	}
-
-	return r
 }
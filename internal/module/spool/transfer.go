@@ -0,0 +1,227 @@
+package spool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	"github.com/team836/clowd-storage/internal/model"
+	"github.com/team836/clowd-storage/pkg/errcorr"
+	"github.com/team836/clowd-storage/pkg/frame"
+)
+
+var (
+	errMalformedShards = errors.New("received shards are different from requested, maybe malformed data")
+)
+
+/**
+Send the shards to save on the node and return the names of the acknowledged shards.
+The shards are sent as raw bytes on the binary protocol,
+or as base64 encoded json on the legacy protocol.
+
+The node which doesn't support the acknowledgement acknowledges nothing,
+so it returns no names even though the shards are sent.
+*/
+func (node *ActiveNode) saveShards(shards []*model.ShardToSave) ([]string, error) {
+	if !node.binary {
+		return node.saveShardsByJSON(shards)
+	}
+
+	id := node.nextID()
+
+	// the node answers an ack frame for each shard with the same request id
+	var c *call
+	if node.Supports(FeatureAck) {
+		c = node.register(id, len(shards), false)
+	}
+
+	// each shard is written separately, so the other requests can be interleaved
+	for _, shard := range shards {
+		f := &frame.Frame{Op: frame.OpSave, RequestID: id, Name: shard.Name, Data: shard.Data}
+		if err := node.writeFrames([]*frame.Frame{f}, saveWait); err != nil {
+			if c != nil {
+				node.unregister(c)
+			}
+			return nil, err
+		}
+	}
+
+	if c == nil {
+		return nil, nil
+	}
+
+	responses, err := node.await(c, ackWait)
+	if err != nil {
+		return nil, err
+	}
+
+	acks := make([]*shardAck, 0, len(responses))
+	for _, resp := range responses {
+		if resp.frame == nil || resp.frame.Op != frame.OpAck {
+			return nil, errMalformedShards
+		}
+
+		acks = append(acks, &shardAck{Name: resp.frame.Name, Checksum: string(resp.frame.Data)})
+	}
+
+	return verifyAcks(shards, acks), nil
+}
+
+/**
+Save the shards by the legacy json protocol.
+*/
+func (node *ActiveNode) saveShardsByJSON(shards []*model.ShardToSave) ([]string, error) {
+	// byte array data are send as base64 encoded format
+	if !node.Supports(FeatureAck) {
+		err := node.writeJSON(&DataMsg{ID: node.nextID(), Type: uploadType, Contents: shards}, saveWait)
+
+		return nil, err
+	}
+
+	c, err := node.requestJSON(uploadType, shards, saveWait)
+	if err != nil {
+		return nil, err
+	}
+
+	responses, err := node.await(c, ackWait)
+	if err != nil {
+		return nil, err
+	}
+
+	acks := make([]*shardAck, 0)
+	if err := json.Unmarshal(responses[0].payload, &acks); err != nil {
+		return nil, err
+	}
+
+	return verifyAcks(shards, acks), nil
+}
+
+/**
+Return the names of the shards whose checksum is acknowledged correctly.
+*/
+func verifyAcks(shards []*model.ShardToSave, acks []*shardAck) []string {
+	checksums := make(map[string]string, len(acks))
+	for _, ack := range acks {
+		checksums[ack.Name] = ack.Checksum
+	}
+
+	acked := make([]string, 0, len(shards))
+	for _, shard := range shards {
+		checksum, ok := checksums[shard.Name]
+		if !ok || errcorr.IsCorruptedChecksum(shard.Data, checksum) {
+			continue
+		}
+
+		acked = append(acked, shard.Name)
+	}
+
+	return acked
+}
+
+/**
+Return the names of the shards.
+*/
+func shardNames(shards []*model.ShardToSave) []string {
+	names := make([]string, 0, len(shards))
+	for _, shard := range shards {
+		names = append(names, shard.Name)
+	}
+
+	return names
+}
+
+/**
+Request the shards to the node and receive their data in order of the shards.
+The waiting is given up when the context is done.
+*/
+func (node *ActiveNode) loadShards(ctx context.Context, shards []*model.ShardToLoad) ([][]byte, error) {
+	if !node.binary {
+		return node.loadShardsByJSON(ctx, shards)
+	}
+
+	// the node answers a frame for each shard with the same request id
+	id := node.nextID()
+	c := node.register(id, len(shards), false)
+
+	requests := make([]*frame.Frame, 0, len(shards))
+	for _, shard := range shards {
+		requests = append(requests, &frame.Frame{Op: frame.OpLoad, RequestID: id, Name: shard.Model.Name})
+	}
+
+	if err := node.writeFrames(requests, msgSendWait); err != nil {
+		node.unregister(c)
+		return nil, err
+	}
+
+	responses, err := node.awaitContext(ctx, c, loadWait)
+	if err != nil {
+		return nil, err
+	}
+
+	// the node may answer the shards in any order
+	received := make(map[string][]byte, len(responses))
+	for _, response := range responses {
+		if response.frame == nil || response.frame.Op != frame.OpShard {
+			return nil, errMalformedShards
+		}
+
+		received[response.frame.Name] = response.frame.Data
+	}
+
+	data := make([][]byte, len(shards))
+	for idx, shard := range shards {
+		shardData, ok := received[shard.Model.Name]
+		if !ok {
+			return nil, errMalformedShards
+		}
+
+		data[idx] = shardData
+	}
+
+	return data, nil
+}
+
+/**
+Request the shards by the legacy json protocol.
+*/
+func (node *ActiveNode) loadShardsByJSON(ctx context.Context, shards []*model.ShardToLoad) ([][]byte, error) {
+	// make download list
+	shardsToDown := make([]*shardToDown, 0, len(shards))
+	for _, shard := range shards {
+		shardsToDown = append(shardsToDown, &shardToDown{Name: shard.Model.Name})
+	}
+
+	// send the download list
+	c, err := node.requestJSON(downloadType, shardsToDown, msgSendWait)
+	if err != nil {
+		return nil, err
+	}
+
+	// receive the shards data
+	responses, err := node.awaitContext(ctx, c, loadWait)
+	if err != nil {
+		return nil, err
+	}
+
+	receivedShards := make([]*model.ShardToSave, 0)
+	if err := json.Unmarshal(responses[0].payload, &receivedShards); err != nil {
+		return nil, err
+	}
+
+	// if count of shards is different
+	if len(shards) != len(receivedShards) {
+		return nil, errMalformedShards
+	}
+
+	data := make([][]byte, len(receivedShards))
+	for idx, receivedShard := range receivedShards {
+		// check if whether received data name is same
+		if shards[idx].Model.Name != receivedShard.Name {
+			return nil, errMalformedShards
+		}
+
+		data[idx] = receivedShard.Data
+	}
+
+	return data, nil
+}
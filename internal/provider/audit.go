@@ -0,0 +1,12 @@
+package provider
+
+import (
+	"github.com/team836/clowd-storage/internal/module/audit"
+)
+
+/**
+Boot audit service.
+*/
+func AuditService() *audit.Daemon {
+	return audit.Service()
+}
@@ -0,0 +1,84 @@
+package provider
+
+import (
+	"github.com/spf13/viper"
+	"github.com/team836/clowd-storage/pkg/errcorr"
+)
+
+/**
+Boot config service.
+Register default values for the optional configs which are not in the env file.
+*/
+func ConfigService() {
+	// weights of the node selection algorithm
+	viper.SetDefault("NODE_SELECTION.WEIGHT.RTT", 0.2)
+	viper.SetDefault("NODE_SELECTION.WEIGHT.BANDWIDTH", 0.15)
+	viper.SetDefault("NODE_SELECTION.WEIGHT.CAPACITY", 0.2)
+	viper.SetDefault("NODE_SELECTION.WEIGHT.UPTIME", 0.1)
+	viper.SetDefault("NODE_SELECTION.WEIGHT.FAILURE", 0.15)
+	viper.SetDefault("NODE_SELECTION.WEIGHT.REPUTATION", 0.2)
+
+	// whether if the shards are spread over the zones declared by clowders
+	viper.SetDefault("PLACEMENT.ZONE_AWARE", false)
+
+	// background repair of the shards on the lost nodes
+	viper.SetDefault("REPAIR.INTERVAL", "10m")
+	viper.SetDefault("REPAIR.BATCH_SIZE", 100)
+
+	// size of the segment which the uploaded file is cut into (Byte)
+	viper.SetDefault("UPLOAD.SEGMENT_SIZE", 64<<20)
+
+	// timeouts of the http server
+	viper.SetDefault("APP.READ_HEADER_TIMEOUT", "5s")
+	viper.SetDefault("APP.READ_TIMEOUT", "10m")
+	viper.SetDefault("APP.WRITE_TIMEOUT", "10m")
+
+	// count of shards to request more than the data shards on download
+	viper.SetDefault("DOWNLOAD.EXTRA_SHARDS", 4)
+	viper.SetDefault("DOWNLOAD.TIMEOUT", "35s")
+
+	// request only the data shards on download when all of them are on the active nodes
+	// The extra shards are requested after the hedge delay if the data shards are slow.
+	viper.SetDefault("DOWNLOAD.PREFER_DATA_SHARDS", true)
+	viper.SetDefault("DOWNLOAD.HEDGE_DELAY", "2s")
+
+	// id of the master key which wraps new data keys
+	viper.SetDefault("ENCRYPTION.ACTIVE_KEY_ID", 1)
+
+	// interval of reporting the loaded master keys for the key rotation
+	viper.SetDefault("ENCRYPTION.REPORT_INTERVAL", "1m")
+
+	// erasure profile which is used when the clowdee doesn't choose
+	viper.SetDefault("ERASURE.DEFAULT_PROFILE", errcorr.DefaultProfileName)
+
+	// proof-of-storage audits of the shards on the nodes
+	viper.SetDefault("AUDIT.INTERVAL", "30m")
+	viper.SetDefault("AUDIT.CHALLENGES_PER_SHARD", 4)
+
+	// period of the session history which the node uptime is calculated for
+	viper.SetDefault("REPUTATION.WINDOW", "168h")
+
+	// nodes whose reputation score is below it are not trusted on the repair prioritisation
+	viper.SetDefault("REPAIR.MIN_REPUTATION", 0.5)
+
+	// lifecycle of the nodes
+	viper.SetDefault("NODE_STATE.CHECK_INTERVAL", "30s")
+	viper.SetDefault("NODE_STATE.OFFLINE_AFTER", "5m")
+	viper.SetDefault("NODE_STATE.LOST_AFTER", "1h")
+	viper.SetDefault("NODE_STATE.SUSPECT_FAILURE_RATE", 0.5)
+
+	// count of shards to copy from the draining node at once
+	viper.SetDefault("DRAIN.BATCH_SIZE", 20)
+
+	// time after which the unacknowledged shard is regarded as not saved
+	viper.SetDefault("SAVE.PENDING_TIMEOUT", "10m")
+
+	// time for which the space of the scheduled shard is reserved on the node
+	viper.SetDefault("RESERVATION.TTL", "2m")
+
+	// heartbeat of the active nodes
+	// Each ping is delayed randomly by the jitter ratio of the interval.
+	viper.SetDefault("HEARTBEAT.INTERVAL", "10s")
+	viper.SetDefault("HEARTBEAT.JITTER", 0.2)
+	viper.SetDefault("HEARTBEAT.STALE_AFTER", "30s")
+}
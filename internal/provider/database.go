@@ -20,6 +20,11 @@ func DBService() *gorm.DB {
 	model.MigrateFile()
 	model.MigrateShard()
 	model.MigrateDeletedShard()
+	model.MigrateAuditChallenge()
+	model.MigrateAuditResult()
+	model.MigrateNodeSession()
+	model.MigrateNodeReputation()
+	model.MigrateServerKey()
 
 	return conn
 }
@@ -0,0 +1,33 @@
+package provider
+
+import (
+	"os"
+
+	"github.com/spf13/viper"
+	"github.com/team836/clowd-storage/internal/module/keyrotation"
+	"github.com/team836/clowd-storage/pkg/encrypt"
+	"github.com/team836/clowd-storage/pkg/logger"
+)
+
+/**
+Boot encryption service.
+Every file is encrypted, so the server cannot start without valid master key.
+*/
+func EncryptionService() {
+	if _, err := encrypt.Keys(); err != nil {
+		logger.Console().Fatalf("Error loading the master keys, %s", err)
+	}
+}
+
+/**
+Boot key report service.
+The key rotation refuses to run until every running server reports the active master key.
+*/
+func KeyReportService() {
+	hostname, err := os.Hostname()
+	if err != nil {
+		logger.Console().Fatalf("Error reading the hostname, %s", err)
+	}
+
+	keyrotation.Report(hostname + ":" + viper.GetString("APP.PORT"))
+}
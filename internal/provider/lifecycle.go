@@ -0,0 +1,15 @@
+package provider
+
+import (
+	"github.com/team836/clowd-storage/internal/module/lifecycle"
+	"github.com/team836/clowd-storage/internal/module/spool"
+)
+
+/**
+Boot lifecycle service.
+*/
+func LifecycleService() *lifecycle.Daemon {
+	return lifecycle.Service(func(machineID string) bool {
+		return spool.Pool().FindActiveNode(machineID) != nil
+	})
+}
@@ -0,0 +1,12 @@
+package provider
+
+import (
+	"github.com/team836/clowd-storage/internal/module/repair"
+)
+
+/**
+Boot repair service.
+*/
+func RepairService() *repair.Daemon {
+	return repair.Service()
+}
@@ -32,9 +32,21 @@ func RouteService() *echo.Echo {
 
 	// basic middleware list
 	basicMiddleware := []echo.MiddlewareFunc{
-		middleware.BodyLimit("200MB"),
+		middleware.BodyLimitWithConfig(middleware.BodyLimitConfig{
+			// streaming upload is not limited because it is cut into segments
+			Skipper: func(ctx echo.Context) bool {
+				return ctx.Path() == "/v1/client/files/stream"
+			},
+			Limit: "200MB",
+		}),
 		middleware.CORS(),
-		middleware.Gzip(),
+		middleware.GzipWithConfig(middleware.GzipConfig{
+			// byte ranges are not compressed to keep the offsets of the original file
+			Skipper: func(ctx echo.Context) bool {
+				return ctx.Path() == "/v1/client/files/:name"
+			},
+			Level: -1,
+		}),
 		middleware.LoggerWithConfig(middleware.LoggerConfig{
 			Format: `{"time":"${time_rfc3339_nano}","remote_ip":"${remote_ip}","host":"${host}",` +
 				`"method":"${method}","uri":"${uri}","status":${status},"error":"${error}",` +
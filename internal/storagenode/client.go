@@ -0,0 +1,338 @@
+package storagenode
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/team836/clowd-storage/pkg/frame"
+	"github.com/team836/clowd-storage/pkg/logger"
+)
+
+const (
+	dialWait = 10 * time.Second
+
+	handshakeWait = 10 * time.Second
+
+	writeWait = 30 * time.Second
+
+	// the server pings periodically, so the silent server is regarded as gone
+	serverSilenceLimit = 2 * time.Minute
+)
+
+const (
+	// the server saves every shards of a quota by one json message
+	maxMessageSize = 1 << 30 // 1GiB
+
+	// count of the frames which wait for the handling
+	frameQueueSize = 16
+)
+
+var (
+	ErrRefused = errors.New("the server refuses the node")
+)
+
+type Config struct {
+	// websocket url of the node api, e.g. `ws://localhost:1234/v1/node`
+	ServerURL string
+
+	// jwt of the clowder who owns this node
+	Token string
+
+	MachineID string
+
+	// failure zone of the node, empty if not declared
+	Zone string
+
+	// network bandwidth reported to the server (Mbps)
+	Bandwidth uint
+
+	// wait before connecting again after the connection is lost
+	ReconnectWait time.Duration
+}
+
+/**
+Client of the storage server which serves the shards in the store.
+*/
+type Client struct {
+	config *Config
+	store  *Store
+}
+
+func NewClient(config *Config, store *Store) *Client {
+	return &Client{config: config, store: store}
+}
+
+/**
+Connection to the server and the features enabled on it.
+*/
+type session struct {
+	client *Client
+	conn   *websocket.Conn
+
+	// serialize the writes on the websocket connection
+	writeLock sync.Mutex
+
+	// whether if the saved shards are acknowledged
+	acks bool
+}
+
+/**
+Keep connected to the server until the context is done.
+Return error only when the server refuses the node,
+because connecting again will be refused too.
+*/
+func (client *Client) Run(ctx context.Context) error {
+	for {
+		err := client.connectAndServe(ctx)
+		if errors.Is(err, ErrRefused) {
+			return err
+		}
+
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		logger.Console().Warnf("Disconnected from the server, %s", err)
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(client.config.ReconnectWait):
+		}
+	}
+}
+
+/**
+Connect to the server, exchange the hello and serve the requests until disconnected.
+*/
+func (client *Client) connectAndServe(ctx context.Context) error {
+	conn, err := client.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	s := &session{client: client, conn: conn}
+	if err := s.handshake(); err != nil {
+		return err
+	}
+
+	logger.Console().Infof("Connected to the server (%s)", conn.Subprotocol())
+
+	return s.serve(ctx)
+}
+
+/**
+Open the websocket connection authenticated as the clowder.
+The binary frames are preferred to the json.
+*/
+func (client *Client) dial(ctx context.Context) (*websocket.Conn, error) {
+	u, err := url.Parse(client.config.ServerURL)
+	if err != nil {
+		return nil, err
+	}
+
+	query := u.Query()
+	query.Set("mid", client.config.MachineID)
+	query.Set("zone", client.config.Zone) // the empty zone clears the declared one
+	u.RawQuery = query.Encode()
+
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+client.config.Token)
+
+	dialer := &websocket.Dialer{
+		HandshakeTimeout: dialWait,
+		Subprotocols:     []string{frame.Subprotocol, frame.JSONSubprotocol},
+	}
+
+	conn, resp, err := dialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		// the unauthorized or decommissioned node cannot be connected again
+		if resp != nil && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden) {
+			return nil, fmt.Errorf("%w, %s", ErrRefused, resp.Status)
+		}
+
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+/**
+Send the hello and wait for the welcome which tells the enabled features.
+*/
+func (s *session) handshake() error {
+	total, err := s.client.store.Total()
+	if err != nil {
+		return err
+	}
+
+	msg := &message{
+		Type: helloType,
+		Contents: &hello{
+			Protocol: ProtocolVersion,
+			Features: []string{featureAck, featureAudit, featureBinary},
+			Software: "clowd-node/" + SoftwareVersion,
+			Storage:  total,
+		},
+	}
+	if err := s.writeJSON(msg); err != nil {
+		return err
+	}
+
+	_ = s.conn.SetReadDeadline(time.Now().Add(handshakeWait))
+	_, data, err := s.conn.ReadMessage()
+	if err != nil {
+		if closeErr, ok := err.(*websocket.CloseError); ok &&
+			(closeErr.Code == closeUnsupportedProtocol || closeErr.Code == closeBadHandshake) {
+			return fmt.Errorf("%w, %s", ErrRefused, closeErr.Text)
+		}
+
+		return err
+	}
+
+	req := &request{}
+	if err := json.Unmarshal(data, req); err != nil {
+		return err
+	}
+	if req.Type != welcomeType {
+		return fmt.Errorf("expected the welcome message but received %q", req.Type)
+	}
+
+	answer := &welcome{}
+	if err := json.Unmarshal(req.Contents, answer); err != nil {
+		return err
+	}
+
+	for _, feature := range answer.Features {
+		if feature == featureAck {
+			s.acks = true
+		}
+	}
+
+	return nil
+}
+
+/**
+Read the requests of the server and handle each of them concurrently.
+*/
+func (s *session) serve(ctx context.Context) error {
+	// close the connection when the node is stopped
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "the node is stopped")
+			_ = s.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(writeWait))
+			_ = s.conn.Close()
+		case <-stopped:
+		}
+	}()
+
+	s.conn.SetReadLimit(maxMessageSize)
+
+	// the ping carries the correlation id of the status request
+	s.conn.SetPingHandler(func(appData string) error {
+		_ = s.conn.SetReadDeadline(time.Now().Add(serverSilenceLimit))
+		_ = s.conn.WriteControl(websocket.PongMessage, []byte(appData), time.Now().Add(writeWait))
+
+		id, _ := strconv.ParseUint(appData, 10, 32)
+		go s.pong(uint32(id))
+
+		return nil
+	})
+
+	// the frames are handled in order, so a shard is never deleted before it is saved
+	frames := make(chan *frame.Frame, frameQueueSize)
+	defer close(frames)
+	go func() {
+		for received := range frames {
+			s.handleFrame(received)
+		}
+	}()
+
+	for {
+		_ = s.conn.SetReadDeadline(time.Now().Add(serverSilenceLimit))
+		messageType, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		switch messageType {
+		case websocket.BinaryMessage:
+			received, err := frame.Read(bytes.NewReader(data), maxMessageSize)
+			if err != nil {
+				return err
+			}
+
+			frames <- received
+		case websocket.TextMessage:
+			req := &request{}
+			if err := json.Unmarshal(data, req); err != nil {
+				logger.Console().Warnf("Malformed request from the server, %s", err)
+				continue
+			}
+
+			go s.handleRequest(req)
+		}
+	}
+}
+
+/**
+Answer the status to the ping.
+*/
+func (s *session) pong(id uint32) {
+	free, err := s.client.store.Free()
+	if err != nil {
+		logger.Console().Errorf("Error measuring the free space, %s", err)
+	}
+
+	// the server measures the rtt by itself
+	contents := &status{Bandwidth: s.client.config.Bandwidth, Capacity: free}
+	if err := s.writeJSON(&message{ID: id, Contents: contents}); err != nil {
+		logger.Console().Warnf("Error answering the ping, %s", err)
+	}
+}
+
+/**
+Write the json message to the server.
+*/
+func (s *session) writeJSON(msg *message) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	_ = s.conn.SetWriteDeadline(time.Now().Add(writeWait))
+
+	return s.conn.WriteJSON(msg)
+}
+
+/**
+Write the frame as a websocket binary message.
+*/
+func (s *session) writeFrame(f *frame.Frame) error {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+
+	_ = s.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	w, err := s.conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+
+	if err := frame.Write(w, f); err != nil {
+		_ = w.Close()
+		return err
+	}
+
+	return w.Close()
+}
@@ -0,0 +1,192 @@
+package storagenode
+
+import (
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/team836/clowd-storage/pkg/errcorr"
+	"github.com/team836/clowd-storage/pkg/frame"
+	"github.com/team836/clowd-storage/pkg/logger"
+)
+
+/**
+Handle the json request of the server.
+*/
+func (s *session) handleRequest(req *request) {
+	var err error
+	switch req.Type {
+	case saveType:
+		err = s.handleSave(req)
+	case downType:
+		err = s.handleDown(req)
+	case deleteType:
+		err = s.handleDelete(req)
+	case auditType:
+		err = s.handleAudit(req)
+	default:
+		logger.Console().Warnf("Unknown request type from the server, %q", req.Type)
+		return
+	}
+
+	if err != nil {
+		logger.Console().Errorf("Error handling %s request, %s", req.Type, err)
+	}
+}
+
+/**
+Save the shards and acknowledge the saved ones with their checksum.
+*/
+func (s *session) handleSave(req *request) error {
+	shards := make([]*shard, 0)
+	if err := json.Unmarshal(req.Contents, &shards); err != nil {
+		return err
+	}
+
+	acks := make([]*shardAck, 0, len(shards))
+	for _, shard := range shards {
+		// the shard which is not acknowledged is placed again by the server
+		if err := s.client.store.Save(shard.Name, shard.Data); err != nil {
+			logger.Console().Errorf("Error saving the shard(%s), %s", shard.Name, err)
+			continue
+		}
+
+		acks = append(acks, &shardAck{Name: shard.Name, Checksum: errcorr.Checksum(shard.Data)})
+	}
+
+	if !s.acks {
+		return nil
+	}
+
+	return s.writeJSON(&message{ID: req.ID, Contents: acks})
+}
+
+/**
+Answer the data of the shards in order of the request.
+The shard which cannot be loaded is answered without data.
+*/
+func (s *session) handleDown(req *request) error {
+	names := make([]*shardName, 0)
+	if err := json.Unmarshal(req.Contents, &names); err != nil {
+		return err
+	}
+
+	shards := make([]*shard, 0, len(names))
+	for _, name := range names {
+		data, err := s.client.store.Load(name.Name)
+		if err != nil {
+			logger.Console().Errorf("Error loading the shard(%s), %s", name.Name, err)
+		}
+
+		shards = append(shards, &shard{Name: name.Name, Data: data})
+	}
+
+	return s.writeJSON(&message{ID: req.ID, Contents: shards})
+}
+
+/**
+Delete the shards. The deletion is not answered.
+*/
+func (s *session) handleDelete(req *request) error {
+	names := make([]*shardName, 0)
+	if err := json.Unmarshal(req.Contents, &names); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := s.client.store.Delete(name.Name); err != nil {
+			logger.Console().Errorf("Error deleting the shard(%s), %s", name.Name, err)
+		}
+	}
+
+	return nil
+}
+
+/**
+Answer the HMAC-SHA256 of the shard data keyed by the nonce.
+The empty hash is answered when the shard cannot be loaded.
+*/
+func (s *session) handleAudit(req *request) error {
+	challenge := &auditChallenge{}
+	if err := json.Unmarshal(req.Contents, challenge); err != nil {
+		return err
+	}
+
+	answer := &auditAnswer{Name: challenge.Name}
+
+	key, err := hex.DecodeString(challenge.Nonce)
+	if err == nil {
+		var data []byte
+		data, err = s.client.store.Load(challenge.Name)
+		if err == nil {
+			answer.Hash = errcorr.KeyedChecksum(data, key)
+		}
+	}
+
+	if err != nil {
+		logger.Console().Errorf("Error answering the audit of the shard(%s), %s", challenge.Name, err)
+	}
+
+	return s.writeJSON(&message{ID: req.ID, Contents: answer})
+}
+
+/**
+Handle the binary frame of the server.
+*/
+func (s *session) handleFrame(received *frame.Frame) {
+	var err error
+	switch received.Op {
+	case frame.OpSave:
+		err = s.handleSaveFrame(received)
+	case frame.OpLoad:
+		err = s.handleLoadFrame(received)
+	default:
+		logger.Console().Warnf("Unexpected frame op from the server, %d", received.Op)
+		return
+	}
+
+	if err != nil {
+		logger.Console().Errorf("Error handling frame of the shard(%s), %s", received.Name, err)
+	}
+}
+
+/**
+Save the shard and acknowledge it.
+The failed shard is acknowledged without checksum so the server doesn't wait for it.
+*/
+func (s *session) handleSaveFrame(received *frame.Frame) error {
+	checksum := ""
+	if err := s.client.store.Save(received.Name, received.Data); err != nil {
+		logger.Console().Errorf("Error saving the shard(%s), %s", received.Name, err)
+	} else {
+		checksum = errcorr.Checksum(received.Data)
+	}
+
+	if !s.acks {
+		return nil
+	}
+
+	return s.writeFrame(&frame.Frame{
+		Op:        frame.OpAck,
+		RequestID: received.RequestID,
+		Name:      received.Name,
+		Data:      []byte(checksum),
+	})
+}
+
+/**
+Answer the data of the shard.
+The shard which cannot be loaded is answered without data.
+*/
+func (s *session) handleLoadFrame(received *frame.Frame) error {
+	data, err := s.client.store.Load(received.Name)
+	if err != nil {
+		logger.Console().Errorf("Error loading the shard(%s), %s", received.Name, err)
+	}
+
+	return s.writeFrame(&frame.Frame{
+		Op:        frame.OpShard,
+		RequestID: received.RequestID,
+		Name:      received.Name,
+		Data:      data,
+	})
+}
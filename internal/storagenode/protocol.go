@@ -0,0 +1,117 @@
+package storagenode
+
+import (
+	"encoding/json"
+)
+
+/**
+Messages of the websocket protocol which the server speaks by `spool.ActiveNode`.
+
+The json request of the server carries the correlation id as `id` field,
+and the node answers with the same id. The ping carries the id as its payload,
+and the node answers its status as json message with the id.
+The shards are transferred as binary frames when the binary subprotocol is negotiated.
+*/
+
+const (
+	// version of the protocol which the node speaks
+	ProtocolVersion = 1
+
+	// version of this node software
+	SoftwareVersion = "0.1.0"
+)
+
+const (
+	helloType = "hello"
+
+	welcomeType = "welcome"
+
+	saveType = "save"
+
+	downType = "down"
+
+	deleteType = "delete"
+
+	auditType = "audit"
+)
+
+const (
+	featureAck = "ack"
+
+	featureAudit = "audit"
+
+	featureBinary = "binary"
+)
+
+/**
+Close codes of the websocket which the server sends when refusing the node.
+*/
+const (
+	closeUnsupportedProtocol = 4001
+
+	closeBadHandshake = 4002
+)
+
+/**
+Message sent to the server.
+The response has no type, and the hello has no id.
+*/
+type message struct {
+	ID       uint32      `json:"id,omitempty"`
+	Type     string      `json:"type,omitempty"`
+	Contents interface{} `json:"contents"`
+}
+
+/**
+Message received from the server.
+*/
+type request struct {
+	ID       uint32          `json:"id"`
+	Type     string          `json:"type"`
+	Contents json.RawMessage `json:"contents"`
+}
+
+type hello struct {
+	Protocol uint16   `json:"protocol"`
+	Features []string `json:"features"`
+	Software string   `json:"software"`
+	Storage  uint64   `json:"storage"` // Byte
+}
+
+type welcome struct {
+	Protocol uint16   `json:"protocol"`
+	Features []string `json:"features"` // features which are enabled by the server
+}
+
+/**
+Status answered to the ping.
+*/
+type status struct {
+	RTT       uint   `json:"rtt"`       // ms
+	Bandwidth uint   `json:"bandwidth"` // Mbps
+	Capacity  uint64 `json:"capacity"`  // free space for the shards (Byte)
+}
+
+type shard struct {
+	Name string `json:"name"`
+	Data []byte `json:"data"` // base64 encoded
+}
+
+type shardName struct {
+	Name string `json:"name"`
+}
+
+type shardAck struct {
+	Name     string `json:"name"`
+	Checksum string `json:"checksum"` // hex encoded sha256
+}
+
+type auditChallenge struct {
+	Name  string `json:"name"`
+	Nonce string `json:"nonce"` // hex encoded
+}
+
+type auditAnswer struct {
+	Name string `json:"name"`
+	Hash string `json:"hash"` // hex encoded
+}
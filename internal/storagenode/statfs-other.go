@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package storagenode
+
+import (
+	"errors"
+)
+
+/**
+The free space of the disk cannot be measured on this platform.
+*/
+func diskFree(dir string) (uint64, error) {
+	return 0, errors.New("measuring the free space of the disk is not supported on this platform")
+}
@@ -0,0 +1,20 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package storagenode
+
+import (
+	"syscall"
+)
+
+/**
+Return the free bytes of the disk which the unprivileged user can use.
+*/
+func diskFree(dir string) (uint64, error) {
+	stat := &syscall.Statfs_t{}
+	if err := syscall.Statfs(dir, stat); err != nil {
+		return 0, err
+	}
+
+	return uint64(stat.Bavail) * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,255 @@
+package storagenode
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// prefix of the temporary files which are not renamed to the shards yet
+	tempPrefix = ".tmp-"
+
+	maxNameSize = 255
+)
+
+var (
+	ErrInvalidName    = errors.New("invalid shard name")
+	ErrLackOfStorage  = errors.New("not enough storage for the shard")
+	ErrShardNotExists = errors.New("the shard does not exist")
+)
+
+/**
+Shard store on the local filesystem.
+Each shard is a file whose name is the shard name.
+*/
+type Store struct {
+	dir string
+
+	// max bytes of the shards, 0 means the whole free space of the disk
+	maxStorage uint64
+
+	// bytes of the stored shards
+	used uint64
+
+	// serialize the updates of the used bytes
+	lock sync.Mutex
+}
+
+/**
+Open the store on the directory.
+The temporary files left by the interrupted writes are removed.
+*/
+func OpenStore(dir string, maxStorage uint64) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &Store{dir: dir, maxStorage: maxStorage}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), tempPrefix) {
+			if err := os.Remove(filepath.Join(dir, file.Name())); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if file.Mode().IsRegular() {
+			store.used += uint64(file.Size())
+		}
+	}
+
+	return store, nil
+}
+
+/**
+Save the shard atomically.
+The data is written to the temporary file and renamed after it is synced,
+so the shard is either the old one or the new one even if the node crashes.
+*/
+func (store *Store) Save(name string, data []byte) error {
+	path, err := store.path(name)
+	if err != nil {
+		return err
+	}
+
+	free, err := store.Free()
+	if err != nil {
+		return err
+	}
+	if free < uint64(len(data)) {
+		return ErrLackOfStorage
+	}
+
+	temp, err := ioutil.TempFile(store.dir, tempPrefix)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(temp.Name()) // no effect after the rename
+	}()
+
+	if _, err := temp.Write(data); err != nil {
+		_ = temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		_ = temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	var replaced uint64 = 0
+	if info, err := os.Stat(path); err == nil {
+		replaced = uint64(info.Size())
+	}
+
+	if err := os.Rename(temp.Name(), path); err != nil {
+		return err
+	}
+
+	// the rename is durable after the directory is synced
+	if err := syncDir(store.dir); err != nil {
+		return err
+	}
+
+	store.used = store.used - replaced + uint64(len(data))
+
+	return nil
+}
+
+/**
+Load the data of the shard.
+*/
+func (store *Store) Load(name string) ([]byte, error) {
+	path, err := store.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrShardNotExists
+	}
+
+	return data, err
+}
+
+/**
+Delete the shard.
+The shard which does not exist is regarded as deleted.
+*/
+func (store *Store) Delete(name string) error {
+	path, err := store.path(name)
+	if err != nil {
+		return err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+
+	store.used -= uint64(info.Size())
+
+	return nil
+}
+
+/**
+Return the bytes which can be stored more.
+It is the smaller of the free space of the disk and the rest of the max storage.
+*/
+func (store *Store) Free() (uint64, error) {
+	free, err := diskFree(store.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	if store.maxStorage == 0 {
+		return free, nil
+	}
+
+	store.lock.Lock()
+	used := store.used
+	store.lock.Unlock()
+
+	remaining := uint64(0)
+	if store.maxStorage > used {
+		remaining = store.maxStorage - used
+	}
+
+	if remaining < free {
+		free = remaining
+	}
+
+	return free, nil
+}
+
+/**
+Return the bytes which the node can provide for the shards in total.
+*/
+func (store *Store) Total() (uint64, error) {
+	free, err := store.Free()
+	if err != nil {
+		return 0, err
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	return store.used + free, nil
+}
+
+/**
+Return the file path of the shard.
+The name is the hex string, so it cannot escape the store directory.
+*/
+func (store *Store) path(name string) (string, error) {
+	if len(name) == 0 || len(name) > maxNameSize {
+		return "", ErrInvalidName
+	}
+
+	for _, c := range name {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return "", ErrInvalidName
+		}
+	}
+
+	return filepath.Join(store.dir, name), nil
+}
+
+/**
+Sync the directory to persist the renamed entries.
+*/
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,207 @@
+package storagenode
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestStore(t *testing.T, maxStorage uint64) (*Store, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+
+	store, err := OpenStore(dir, maxStorage)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		t.Fatalf("OpenStore() error = %v", err)
+	}
+
+	return store, func() {
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestStoreSaveLoad(t *testing.T) {
+	store, remove := newTestStore(t, 0)
+	defer remove()
+
+	tests := []struct {
+		name     string
+		shard    string
+		data     []byte
+		wantUsed uint64
+	}{
+		{"new shard", "0a", []byte("data"), 4},
+		{"other shard", "0b", []byte("other"), 9},
+		{"replace the shard", "0a", []byte("replaced"), 13},
+		{"empty shard", "0c", []byte{}, 13},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := store.Save(test.shard, test.data); err != nil {
+				t.Fatalf("Save() error = %v", err)
+			}
+
+			loaded, err := store.Load(test.shard)
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+
+			if !bytes.Equal(loaded, test.data) {
+				t.Errorf("Load() = %q, want %q", loaded, test.data)
+			}
+
+			if store.used != test.wantUsed {
+				t.Errorf("used = %d, want %d", store.used, test.wantUsed)
+			}
+		})
+	}
+
+	// no temporary file is left after the saves
+	files, err := ioutil.ReadDir(store.dir)
+	if err != nil {
+		t.Fatalf("ReadDir() error = %v", err)
+	}
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), tempPrefix) {
+			t.Errorf("temporary file %s is left", file.Name())
+		}
+	}
+}
+
+func TestStoreLoadMissing(t *testing.T) {
+	store, remove := newTestStore(t, 0)
+	defer remove()
+
+	if err := store.Save("0a", []byte("data")); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if err := store.Delete("0a"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		shard string
+	}{
+		{"never saved", "0b"},
+		{"deleted", "0a"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := store.Load(test.shard); err != ErrShardNotExists {
+				t.Errorf("Load() error = %v, want %v", err, ErrShardNotExists)
+			}
+		})
+	}
+
+	// deleting the missing shard is not an error
+	if err := store.Delete("0b"); err != nil {
+		t.Errorf("Delete() error = %v, want nil", err)
+	}
+
+	if store.used != 0 {
+		t.Errorf("used = %d, want 0", store.used)
+	}
+}
+
+func TestStoreInvalidName(t *testing.T) {
+	store, remove := newTestStore(t, 0)
+	defer remove()
+
+	tests := []struct {
+		name  string
+		shard string
+	}{
+		{"empty", ""},
+		{"upper case hex", "0A"},
+		{"not hex", "shard"},
+		{"parent directory", "../0a"},
+		{"path separator", "0a/0b"},
+		{"temporary file", tempPrefix + "0a"},
+		{"too long", strings.Repeat("a", maxNameSize+1)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := store.Save(test.shard, []byte("data")); err != ErrInvalidName {
+				t.Errorf("Save() error = %v, want %v", err, ErrInvalidName)
+			}
+
+			if _, err := store.Load(test.shard); err != ErrInvalidName {
+				t.Errorf("Load() error = %v, want %v", err, ErrInvalidName)
+			}
+
+			if err := store.Delete(test.shard); err != ErrInvalidName {
+				t.Errorf("Delete() error = %v, want %v", err, ErrInvalidName)
+			}
+		})
+	}
+}
+
+func TestStoreMaxStorage(t *testing.T) {
+	store, remove := newTestStore(t, 10)
+	defer remove()
+
+	tests := []struct {
+		name    string
+		shard   string
+		size    int
+		wantErr error
+	}{
+		{"within the max storage", "0a", 6, nil},
+		{"over the max storage", "0b", 5, ErrLackOfStorage},
+		{"fill the rest", "0b", 4, nil},
+		{"nothing left", "0c", 1, ErrLackOfStorage},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := store.Save(test.shard, make([]byte, test.size)); err != test.wantErr {
+				t.Errorf("Save() error = %v, want %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestOpenStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatalf("TempDir() error = %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// the shards and the temporary file left by the interrupted save
+	files := map[string]string{
+		"0a":              "data",
+		"0b":              "other",
+		tempPrefix + "01": "interrupted",
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+	}
+
+	store, err := OpenStore(dir, 0)
+	if err != nil {
+		t.Fatalf("OpenStore() error = %v", err)
+	}
+
+	if store.used != 9 {
+		t.Errorf("used = %d, want 9", store.used)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, tempPrefix+"01")); !os.IsNotExist(err) {
+		t.Errorf("temporary file is not removed, stat error = %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+package encrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+)
+
+/**
+The data is sealed chunk by chunk using AES-GCM,
+so any range of the data can be opened without the whole data.
+
+Each chunk uses the nonce made of its index and whether if it is the last chunk.
+The nonce never repeats because every data key is used for only one data.
+Reordering, truncating and extending the chunks are detected by the nonce.
+Every chunk also authenticates the associated data of the cipher,
+so the sealed data cannot be opened as the other data.
+*/
+const (
+	// size of the plain chunk (Byte)
+	ChunkSize = 64 * 1024
+
+	// size of the authentication tag appended to each chunk (Byte)
+	Overhead = 16
+
+	// size of the sealed chunk (Byte)
+	SealedChunkSize = ChunkSize + Overhead
+
+	// size of the data key (Byte)
+	KeySize = 32
+)
+
+var (
+	ErrInvalidSealedData = errors.New("sealed data is malformed")
+)
+
+/**
+Cipher which seals and opens the data with the data key.
+*/
+type Cipher struct {
+	aead cipher.AEAD
+	aad  []byte
+}
+
+/**
+Create new cipher with the data key and the associated data of every chunk.
+*/
+func NewCipher(dataKey, aad []byte) (*Cipher, error) {
+	block, err := aes.NewCipher(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Cipher{aead: aead, aad: aad}, nil
+}
+
+/**
+Seal the whole data.
+*/
+func (c *Cipher) Seal(plain []byte) []byte {
+	chunkCount := ChunkCount(len(plain))
+	sealed := make([]byte, 0, SealedSize(len(plain)))
+
+	for idx := 0; idx < chunkCount; idx++ {
+		start := idx * ChunkSize
+		end := start + ChunkSize
+		if end > len(plain) {
+			end = len(plain)
+		}
+
+		sealed = c.aead.Seal(sealed, nonce(idx, idx == chunkCount-1), plain[start:end], c.aad)
+	}
+
+	return sealed
+}
+
+/**
+Open the whole sealed data.
+*/
+func (c *Cipher) Open(sealed []byte) ([]byte, error) {
+	chunkCount := (len(sealed) + SealedChunkSize - 1) / SealedChunkSize
+	if chunkCount == 0 {
+		return nil, ErrInvalidSealedData
+	}
+
+	return c.OpenChunks(sealed, 0, chunkCount)
+}
+
+/**
+Open the consecutive sealed chunks which start from the `firstChunk`.
+The `chunkCount` is count of all chunks of the whole data
+which is needed for checking the last chunk.
+*/
+func (c *Cipher) OpenChunks(sealed []byte, firstChunk, chunkCount int) ([]byte, error) {
+	plain := make([]byte, 0, len(sealed))
+
+	for idx := firstChunk; len(sealed) > 0; idx++ {
+		if idx >= chunkCount {
+			return nil, ErrInvalidSealedData
+		}
+
+		end := SealedChunkSize
+		if end > len(sealed) {
+			end = len(sealed)
+		}
+
+		var err error
+		plain, err = c.aead.Open(plain, nonce(idx, idx == chunkCount-1), sealed[:end], c.aad)
+		if err != nil {
+			return nil, err
+		}
+
+		sealed = sealed[end:]
+	}
+
+	return plain, nil
+}
+
+/**
+Return the count of chunks of the plain data.
+Even the empty data has one chunk for the authentication.
+*/
+func ChunkCount(plainSize int) int {
+	if plainSize == 0 {
+		return 1
+	}
+
+	return (plainSize + ChunkSize - 1) / ChunkSize
+}
+
+/**
+Return the size of the sealed data.
+*/
+func SealedSize(plainSize int) int {
+	return plainSize + ChunkCount(plainSize)*Overhead
+}
+
+/**
+Make the nonce of the chunk.
+*/
+func nonce(idx int, last bool) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n, uint64(idx))
+	if last {
+		n[11] = 1
+	}
+
+	return n
+}
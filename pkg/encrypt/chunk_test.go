@@ -0,0 +1,195 @@
+package encrypt
+
+import (
+	"bytes"
+	"testing"
+)
+
+func newTestCipher(t *testing.T) *Cipher {
+	t.Helper()
+
+	dataKey, err := NewDataKey()
+	if err != nil {
+		t.Fatalf("NewDataKey() error = %v", err)
+	}
+
+	c, err := NewCipher(dataKey, []byte("file"))
+	if err != nil {
+		t.Fatalf("NewCipher() error = %v", err)
+	}
+
+	return c
+}
+
+func testData(size int) []byte {
+	data := make([]byte, size)
+	for idx := range data {
+		data[idx] = byte(idx * 7)
+	}
+
+	return data
+}
+
+func TestSealOpen(t *testing.T) {
+	c := newTestCipher(t)
+
+	tests := []struct {
+		name   string
+		size   int
+		chunks int
+	}{
+		{"empty", 0, 1},
+		{"one byte", 1, 1},
+		{"under chunk", ChunkSize - 1, 1},
+		{"exact chunk", ChunkSize, 1},
+		{"over chunk", ChunkSize + 1, 2},
+		{"several chunks", 3*ChunkSize + 5, 4},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			plain := testData(test.size)
+
+			if got := ChunkCount(test.size); got != test.chunks {
+				t.Errorf("ChunkCount() = %d, want %d", got, test.chunks)
+			}
+
+			sealed := c.Seal(plain)
+			if len(sealed) != SealedSize(test.size) {
+				t.Errorf("len(Seal()) = %d, want %d", len(sealed), SealedSize(test.size))
+			}
+
+			opened, err := c.Open(sealed)
+			if err != nil {
+				t.Fatalf("Open() error = %v", err)
+			}
+
+			if !bytes.Equal(opened, plain) {
+				t.Errorf("Open() does not match the plain data")
+			}
+		})
+	}
+}
+
+func TestOpenChunks(t *testing.T) {
+	c := newTestCipher(t)
+	plain := testData(4*ChunkSize + 100)
+	sealed := c.Seal(plain)
+	chunkCount := ChunkCount(len(plain))
+
+	tests := []struct {
+		name       string
+		firstChunk int
+		lastChunk  int // exclusive
+	}{
+		{"first", 0, 1},
+		{"middle", 1, 3},
+		{"last", 4, 5},
+		{"all", 0, 5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sealedEnd := test.lastChunk * SealedChunkSize
+			if sealedEnd > len(sealed) {
+				sealedEnd = len(sealed)
+			}
+			plainEnd := test.lastChunk * ChunkSize
+			if plainEnd > len(plain) {
+				plainEnd = len(plain)
+			}
+
+			opened, err := c.OpenChunks(sealed[test.firstChunk*SealedChunkSize:sealedEnd], test.firstChunk, chunkCount)
+			if err != nil {
+				t.Fatalf("OpenChunks() error = %v", err)
+			}
+
+			if !bytes.Equal(opened, plain[test.firstChunk*ChunkSize:plainEnd]) {
+				t.Errorf("OpenChunks() does not match the plain data")
+			}
+		})
+	}
+}
+
+func TestOpenTampered(t *testing.T) {
+	c := newTestCipher(t)
+	sealed := c.Seal(testData(3 * ChunkSize))
+
+	flipped := append([]byte{}, sealed...)
+	flipped[SealedChunkSize+10] ^= 1
+
+	reordered := append([]byte{}, sealed[SealedChunkSize:2*SealedChunkSize]...)
+	reordered = append(reordered, sealed[:SealedChunkSize]...)
+	reordered = append(reordered, sealed[2*SealedChunkSize:]...)
+
+	extended := append([]byte{}, sealed...)
+	extended = append(extended, sealed[2*SealedChunkSize:]...)
+
+	tests := []struct {
+		name   string
+		sealed []byte
+	}{
+		{"empty", nil},
+		{"flipped bit", flipped},
+		{"reordered chunks", reordered},
+		{"truncated chunks", sealed[:2*SealedChunkSize]},
+		{"truncated tag", sealed[:len(sealed)-1]},
+		{"extended chunks", extended},
+		{"too short", sealed[:Overhead-1]},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := c.Open(test.sealed); err == nil {
+				t.Errorf("Open() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestOpenOtherAAD(t *testing.T) {
+	dataKey, err := NewDataKey()
+	if err != nil {
+		t.Fatalf("NewDataKey() error = %v", err)
+	}
+
+	sealer, err := NewCipher(dataKey, []byte("file"))
+	if err != nil {
+		t.Fatalf("NewCipher() error = %v", err)
+	}
+	sealed := sealer.Seal(testData(2 * ChunkSize))
+
+	tests := []struct {
+		name string
+		aad  []byte
+	}{
+		{"other aad", []byte("other")},
+		{"nil aad", nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := NewCipher(dataKey, test.aad)
+			if err != nil {
+				t.Fatalf("NewCipher() error = %v", err)
+			}
+
+			if _, err := c.Open(sealed); err == nil {
+				t.Errorf("Open() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestOpenChunksOutOfRange(t *testing.T) {
+	c := newTestCipher(t)
+	sealed := c.Seal(testData(2 * ChunkSize))
+
+	// the data after the last chunk
+	lastChunk := sealed[SealedChunkSize:]
+	extended := append(append([]byte{}, lastChunk...), lastChunk...)
+
+	if _, err := c.OpenChunks(extended, 1, 2); err != ErrInvalidSealedData {
+		t.Errorf("OpenChunks() error = %v, want %v", err, ErrInvalidSealedData)
+	}
+}
@@ -0,0 +1,210 @@
+package encrypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+var (
+	ErrInvalidMasterKey = errors.New("master key must be base64 encoded 32 bytes")
+
+	ErrMasterKeyNotExist = errors.New("master key is not exists")
+
+	ErrInvalidWrappedKey = errors.New("wrapped key is malformed")
+)
+
+var (
+	keyRing    *KeyRing  // singleton instance
+	keyRingErr error     // error of loading the key ring
+	once       sync.Once // for thread safe singleton
+)
+
+/**
+Registry of the versioned master keys.
+
+New data keys are always wrapped by the active master key.
+The old master keys remain for unwrapping the data keys
+until every data key is re-wrapped by the active master key.
+*/
+type KeyRing struct {
+	// master keys by key id
+	keys map[uint16][]byte
+
+	// id of the master key which wraps new data keys
+	activeID uint16
+}
+
+/**
+Return the singleton key ring which is loaded from the config.
+*/
+func Keys() (*KeyRing, error) {
+	once.Do(func() {
+		keyRing, keyRingErr = loadKeyRing()
+	})
+
+	return keyRing, keyRingErr
+}
+
+/**
+Load the master keys from the config.
+The single `MASTER_KEY` config is regarded as the master key whose id is 1.
+*/
+func loadKeyRing() (*KeyRing, error) {
+	ring := &KeyRing{
+		keys:     make(map[uint16][]byte),
+		activeID: uint16(viper.GetUint("ENCRYPTION.ACTIVE_KEY_ID")),
+	}
+
+	encodedKeys := viper.GetStringMapString("ENCRYPTION.MASTER_KEYS")
+	if len(encodedKeys) == 0 {
+		encodedKeys = map[string]string{"1": viper.GetString("ENCRYPTION.MASTER_KEY")}
+	}
+
+	for encodedID, encodedKey := range encodedKeys {
+		id, err := strconv.ParseUint(encodedID, 10, 16)
+		if err != nil {
+			return nil, ErrInvalidMasterKey
+		}
+
+		key, err := decodeKey(encodedKey)
+		if err != nil {
+			return nil, err
+		}
+
+		ring.keys[uint16(id)] = key
+	}
+
+	if _, ok := ring.keys[ring.activeID]; !ok {
+		return nil, ErrMasterKeyNotExist
+	}
+
+	return ring, nil
+}
+
+/**
+Decode the base64 encoded key.
+*/
+func decodeKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != KeySize {
+		return nil, ErrInvalidMasterKey
+	}
+
+	return key, nil
+}
+
+/**
+Return the active master key with its id.
+*/
+func (ring *KeyRing) Active() (uint16, []byte) {
+	return ring.activeID, ring.keys[ring.activeID]
+}
+
+/**
+Return the ids of every master key in ascending order.
+*/
+func (ring *KeyRing) IDs() []uint16 {
+	ids := make([]uint16, 0, len(ring.keys))
+	for id := range ring.keys {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	return ids
+}
+
+/**
+Find the master key by id.
+*/
+func (ring *KeyRing) Find(id uint16) ([]byte, error) {
+	key, ok := ring.keys[id]
+	if !ok {
+		return nil, ErrMasterKeyNotExist
+	}
+
+	return key, nil
+}
+
+/**
+Generate new random data key.
+*/
+func NewDataKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+/**
+Wrap the data key with the master key.
+The wrapped key is the random nonce followed by the sealed data key.
+
+The `aad` is authenticated with the data key,
+so the wrapped key can only be unwrapped with the same `aad`.
+*/
+func WrapKey(dataKey, masterKey, aad []byte) ([]byte, error) {
+	aead, err := newKeyAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	n := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, n); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(n, n, dataKey, aad), nil
+}
+
+/**
+Unwrap the data key with the master key.
+It fails if the `aad` differs from the one which is used for wrapping.
+*/
+func UnwrapKey(wrappedKey, masterKey, aad []byte) ([]byte, error) {
+	aead, err := newKeyAEAD(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wrappedKey) < aead.NonceSize()+aead.Overhead() {
+		return nil, ErrInvalidWrappedKey
+	}
+
+	n, sealed := wrappedKey[:aead.NonceSize()], wrappedKey[aead.NonceSize():]
+
+	return aead.Open(nil, n, sealed, aad)
+}
+
+/**
+Re-wrap the data key which is wrapped by the old master key with the new master key.
+Each master key has its own `aad` because the `aad` can include the id of the master key.
+*/
+func RewrapKey(wrappedKey, oldMasterKey, oldAAD, newMasterKey, newAAD []byte) ([]byte, error) {
+	dataKey, err := UnwrapKey(wrappedKey, oldMasterKey, oldAAD)
+	if err != nil {
+		return nil, err
+	}
+
+	return WrapKey(dataKey, newMasterKey, newAAD)
+}
+
+func newKeyAEAD(masterKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,95 @@
+package encrypt
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestUnwrapKey(t *testing.T) {
+	dataKey, err := NewDataKey()
+	if err != nil {
+		t.Fatalf("NewDataKey() error = %v", err)
+	}
+
+	masterKey, err := NewDataKey()
+	if err != nil {
+		t.Fatalf("NewDataKey() error = %v", err)
+	}
+
+	otherKey, err := NewDataKey()
+	if err != nil {
+		t.Fatalf("NewDataKey() error = %v", err)
+	}
+
+	wrappedKey, err := WrapKey(dataKey, masterKey, []byte("file-1"))
+	if err != nil {
+		t.Fatalf("WrapKey() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		wrappedKey []byte
+		masterKey  []byte
+		aad        []byte
+		wantErr    bool
+	}{
+		{"same aad", wrappedKey, masterKey, []byte("file-1"), false},
+		{"other aad", wrappedKey, masterKey, []byte("file-2"), true},
+		{"nil aad", wrappedKey, masterKey, nil, true},
+		{"other master key", wrappedKey, otherKey, []byte("file-1"), true},
+		{"too short", wrappedKey[:10], masterKey, []byte("file-1"), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := UnwrapKey(test.wrappedKey, test.masterKey, test.aad)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("UnwrapKey() error = %v, want error %v", err, test.wantErr)
+			}
+
+			if !test.wantErr && !bytes.Equal(got, dataKey) {
+				t.Errorf("UnwrapKey() does not match the data key")
+			}
+		})
+	}
+}
+
+func TestRewrapKey(t *testing.T) {
+	dataKey, err := NewDataKey()
+	if err != nil {
+		t.Fatalf("NewDataKey() error = %v", err)
+	}
+
+	oldKey, err := NewDataKey()
+	if err != nil {
+		t.Fatalf("NewDataKey() error = %v", err)
+	}
+
+	newKey, err := NewDataKey()
+	if err != nil {
+		t.Fatalf("NewDataKey() error = %v", err)
+	}
+
+	wrappedKey, err := WrapKey(dataKey, oldKey, []byte("old"))
+	if err != nil {
+		t.Fatalf("WrapKey() error = %v", err)
+	}
+
+	if _, err := RewrapKey(wrappedKey, oldKey, []byte("other"), newKey, []byte("new")); err == nil {
+		t.Errorf("RewrapKey() with the other old aad error = nil, want error")
+	}
+
+	rewrapped, err := RewrapKey(wrappedKey, oldKey, []byte("old"), newKey, []byte("new"))
+	if err != nil {
+		t.Fatalf("RewrapKey() error = %v", err)
+	}
+
+	got, err := UnwrapKey(rewrapped, newKey, []byte("new"))
+	if err != nil {
+		t.Fatalf("UnwrapKey() error = %v", err)
+	}
+
+	if !bytes.Equal(got, dataKey) {
+		t.Errorf("UnwrapKey() does not match the data key")
+	}
+}
@@ -1,6 +1,7 @@
 package errcorr
 
 import (
+	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 )
@@ -19,3 +20,13 @@ Check whether if the checksum of specific data is valid
 func IsCorruptedChecksum(data []byte, checksum string) bool {
 	return Checksum(data) != checksum
 }
+
+/**
+Generate HMAC-SHA256 keyed checksum of the shard.
+Only who has the whole shard data can generate it for the random key.
+*/
+func KeyedChecksum(data []byte, key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,100 @@
+package errcorr
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+/**
+Expansion factor of shards determine durability of recovery.
+
+Exp. factor = (count of parity shards) / (count of data shards)
+
+With the default profile, our percentage of recovery is 99.970766304935266% given 10% failure.
+(See https://storj.io/storjv3.pdf document)
+*/
+const (
+	// name of the default profile
+	DefaultProfileName = "default"
+
+	// count of data shards of the default profile
+	DefaultDataShards = 30
+
+	// count of parity shards of the default profile
+	DefaultParityShards = 20
+)
+
+const (
+	// maximum count of all shards which reed solomon supports
+	maxTotalShards = 256
+)
+
+var (
+	ErrProfileNotExist = errors.New("erasure profile is not exists")
+
+	ErrInvalidProfile = errors.New("erasure profile is invalid")
+)
+
+/**
+Erasure coding profile which decides count of data and parity shards.
+*/
+type Profile struct {
+	Name         string
+	DataShards   int
+	ParityShards int
+}
+
+/**
+Find the erasure profile defined in the config by name.
+If the name is empty, find the default profile of the config.
+*/
+func FindProfile(name string) (*Profile, error) {
+	if name == "" {
+		name = viper.GetString("ERASURE.DEFAULT_PROFILE")
+	}
+
+	key := "ERASURE.PROFILES." + strings.ToLower(name)
+
+	// the default profile is always available
+	if !viper.IsSet(key) {
+		if name == DefaultProfileName {
+			return &Profile{
+				Name:         DefaultProfileName,
+				DataShards:   DefaultDataShards,
+				ParityShards: DefaultParityShards,
+			}, nil
+		}
+
+		return nil, ErrProfileNotExist
+	}
+
+	profile := &Profile{
+		Name:         name,
+		DataShards:   viper.GetInt(key + ".DATA"),
+		ParityShards: viper.GetInt(key + ".PARITY"),
+	}
+
+	if !profile.IsValid() {
+		return nil, ErrInvalidProfile
+	}
+
+	return profile, nil
+}
+
+/**
+Check whether if the count of shards can be handled.
+*/
+func (profile *Profile) IsValid() bool {
+	return profile.DataShards > 0 &&
+		profile.ParityShards > 0 &&
+		profile.TotalShards() <= maxTotalShards
+}
+
+/**
+Return the count of all shards.
+*/
+func (profile *Profile) TotalShards() int {
+	return profile.DataShards + profile.ParityShards
+}
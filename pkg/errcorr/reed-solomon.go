@@ -2,92 +2,104 @@ package errcorr
 
 import (
 	"bytes"
-	"encoding/base64"
 
 	"github.com/klauspost/reedsolomon"
 )
 
 /**
-Expansion factor of shards determine durability of recovery.
-
-Exp. factor = (count of parity shards) / (count of data shards)
-
-Currently our percentage of recovery is 99.970766304935266% given 10% failure.
-(See https://storj.io/storjv3.pdf document)
-*/
-const (
-	// count of data shards
-	dataShards = 30
-
-	// count of parity shards
-	parityShards = 20
-)
-
-/**
-Encode the file data using reed solomon algorithm.
+Encode the raw file data using reed solomon algorithm.
+The data shards share the memory with the given data if its capacity permits.
 */
-func Encode(base64Data string) ([][]byte, uint, error) {
-	// convert base64 data to byte array
-	bytes, err := base64.StdEncoding.DecodeString(base64Data)
+func (profile *Profile) EncodeBytes(data []byte) ([][]byte, error) {
+	// create reed solomon encoder
+	enc, err := profile.encoder()
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 
-	// create reed solomon encoder
-	enc, _ := reedsolomon.New(dataShards, parityShards)
-
 	// split the file data
-	splitData, err := enc.Split(bytes)
+	splitData, err := enc.Split(data)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 
 	// encode the split file using reed solomon algorithm
 	err = enc.Encode(splitData)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 
-	return splitData, uint(len(bytes)), nil
+	return splitData, nil
+}
+
+/**
+Reconstruct the missing(nil) shards in place using reed solomon algorithm.
+*/
+func (profile *Profile) Reconstruct(shards [][]byte) error {
+	// create read solomon encoder
+	enc, err := profile.encoder()
+	if err != nil {
+		return err
+	}
+
+	return enc.Reconstruct(shards)
 }
 
 /**
 Decode the shards to the original file using reed solomon algorithm.
-When some data are missed, reconstruct them.
+When some data shards are missed, reconstruct the missing shards in place.
+Otherwise, join the data shards directly without touching the parity shards.
 */
-func Decode(shards [][]byte, dataSize int) (string, [][]byte, error) {
-	// collect missing shard index
-	var missingIndexes []int
-	for idx, shard := range shards {
-		if shard == nil {
-			missingIndexes = append(missingIndexes, idx)
+func (profile *Profile) Decode(shards [][]byte, dataSize int) ([]byte, error) {
+	// decode(reconstruct) the missing shards only if needed
+	if !profile.IsDataIntact(shards) {
+		if err := profile.Reconstruct(shards); err != nil {
+			return nil, err
 		}
 	}
 
 	// create read solomon encoder
-	enc, _ := reedsolomon.New(dataShards, parityShards)
-
-	// decode(reconstruct) the missing shards
-	err := enc.Reconstruct(shards)
+	enc, err := profile.encoder()
 	if err != nil {
-		return "", nil, err
-	}
-
-	// collect reconstructed shards
-	reconstructedData := make([][]byte, 0)
-	for _, idx := range missingIndexes {
-		reconstructedData = append(reconstructedData, shards[idx])
+		return nil, err
 	}
 
 	// join the all shards
 	buf := &bytes.Buffer{}
-	err = enc.Join(buf, shards, dataSize)
-	if err != nil {
-		return "", nil, err
+	if err := enc.Join(buf, shards, dataSize); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+/**
+Check whether if all data shards exist.
+*/
+func (profile *Profile) IsDataIntact(shards [][]byte) bool {
+	if len(shards) < profile.DataShards {
+		return false
+	}
+
+	for _, shard := range shards[:profile.DataShards] {
+		if shard == nil {
+			return false
+		}
 	}
 
-	// convert byte array to base64 string
-	fileData := base64.StdEncoding.EncodeToString(buf.Bytes())
+	return true
+}
+
+/**
+Return the size of each shard for the file data.
+*/
+func (profile *Profile) ShardSize(dataSize int) int {
+	return (dataSize + profile.DataShards - 1) / profile.DataShards
+}
 
-	return fileData, reconstructedData, nil
+/**
+Create the reed solomon encoder for this profile.
+*/
+func (profile *Profile) encoder() (reedsolomon.Encoder, error) {
+	return reedsolomon.New(profile.DataShards, profile.ParityShards)
 }
@@ -0,0 +1,126 @@
+package frame
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+/**
+Binary frame for the shard transfer over the websocket.
+Each websocket binary message carries exactly one frame.
+
+	+---------+----+------------+----------+------+------------+------+
+	| version | op | request id | name len | name | data len   | data |
+	| 1       | 1  | 4          | 2        | ...  | 4          | ...  |
+	+---------+----+------------+----------+------+------------+------+
+
+Every integers are big endian.
+*/
+const (
+	// current version of the frame format
+	Version = 1
+
+	// websocket subprotocol of the binary frames
+	Subprotocol = "clowd.binary.v1"
+
+	// websocket subprotocol of the legacy json messages
+	JSONSubprotocol = "clowd.json"
+
+	// size of the fixed header fields except the name (Byte)
+	headerSize = 1 + 1 + 4 + 2 + 4
+
+	// max length of the shard name
+	maxNameSize = 1<<16 - 1
+)
+
+type Op uint8
+
+const (
+	// save the shard on the node (server → node)
+	OpSave Op = 1
+
+	// request the shard from the node without data (server → node)
+	OpLoad Op = 2
+
+	// shard data answered for the load request (node → server)
+	OpShard Op = 3
+
+	// acknowledgement of the saved shard whose data is the hex encoded checksum (node → server)
+	OpAck Op = 4
+)
+
+var (
+	ErrUnknownVersion = errors.New("unknown frame version")
+	ErrTooLarge       = errors.New("frame is too large")
+)
+
+type Frame struct {
+	Op        Op
+	RequestID uint32
+	Name      string
+	Data      []byte
+}
+
+/**
+Write the frame to the writer.
+*/
+func Write(w io.Writer, frame *Frame) error {
+	if len(frame.Name) > maxNameSize || uint64(len(frame.Data)) > uint64(^uint32(0)) {
+		return ErrTooLarge
+	}
+
+	header := make([]byte, headerSize+len(frame.Name))
+	header[0] = Version
+	header[1] = byte(frame.Op)
+	binary.BigEndian.PutUint32(header[2:6], frame.RequestID)
+	binary.BigEndian.PutUint16(header[6:8], uint16(len(frame.Name)))
+	copy(header[8:], frame.Name)
+	binary.BigEndian.PutUint32(header[8+len(frame.Name):], uint32(len(frame.Data)))
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	_, err := w.Write(frame.Data)
+	return err
+}
+
+/**
+Read the frame from the reader.
+The frame whose data is larger than the max data size is rejected before reading the data.
+*/
+func Read(r io.Reader, maxDataSize int) (*Frame, error) {
+	fixed := make([]byte, 8)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, err
+	}
+
+	if fixed[0] != Version {
+		return nil, ErrUnknownVersion
+	}
+
+	frame := &Frame{
+		Op:        Op(fixed[1]),
+		RequestID: binary.BigEndian.Uint32(fixed[2:6]),
+	}
+
+	// read the name and the data length
+	rest := make([]byte, int(binary.BigEndian.Uint16(fixed[6:8]))+4)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+	frame.Name = string(rest[:len(rest)-4])
+
+	dataSize := binary.BigEndian.Uint32(rest[len(rest)-4:])
+	if uint64(dataSize) > uint64(maxDataSize) {
+		return nil, ErrTooLarge
+	}
+
+	frame.Data = make([]byte, dataSize)
+	if _, err := io.ReadFull(r, frame.Data); err != nil {
+		return nil, err
+	}
+
+	return frame, nil
+}
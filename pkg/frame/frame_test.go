@@ -0,0 +1,95 @@
+package frame
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame *Frame
+	}{
+		{"save", &Frame{Op: OpSave, RequestID: 1, Name: "shard-0", Data: []byte("data")}},
+		{"load without data", &Frame{Op: OpLoad, RequestID: 2, Name: "shard-1"}},
+		{"max request id", &Frame{Op: OpShard, RequestID: ^uint32(0), Name: "shard-2", Data: []byte("data")}},
+		{"ack", &Frame{Op: OpAck, RequestID: 5, Name: "shard-3", Data: []byte("0123abcd")}},
+		{"empty name", &Frame{Op: OpShard, RequestID: 3, Data: []byte{0, 1, 2}}},
+		{"max name", &Frame{Op: OpShard, RequestID: 4, Name: strings.Repeat("n", maxNameSize)}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			if err := Write(buf, test.frame); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+
+			read, err := Read(buf, len(test.frame.Data))
+			if err != nil {
+				t.Fatalf("Read() error = %v", err)
+			}
+
+			if read.Op != test.frame.Op ||
+				read.RequestID != test.frame.RequestID ||
+				read.Name != test.frame.Name ||
+				!bytes.Equal(read.Data, test.frame.Data) {
+				t.Errorf("Read() = %+v, want %+v", read, test.frame)
+			}
+
+			if buf.Len() != 0 {
+				t.Errorf("Read() left %d bytes", buf.Len())
+			}
+		})
+	}
+}
+
+func TestWriteTooLarge(t *testing.T) {
+	f := &Frame{Op: OpSave, Name: strings.Repeat("n", maxNameSize+1)}
+	if err := Write(&bytes.Buffer{}, f); err != ErrTooLarge {
+		t.Errorf("Write() error = %v, want %v", err, ErrTooLarge)
+	}
+}
+
+func TestReadMalformed(t *testing.T) {
+	encoded := &bytes.Buffer{}
+	if err := Write(encoded, &Frame{Op: OpShard, RequestID: 7, Name: "shard", Data: []byte("data")}); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	valid := encoded.Bytes()
+
+	unknownVersion := append([]byte{}, valid...)
+	unknownVersion[0] = Version + 1
+
+	oversize := append([]byte{}, valid[:8+len("shard")]...)
+	oversize = append(oversize, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(oversize[len(oversize)-4:], ^uint32(0))
+
+	tests := []struct {
+		name        string
+		data        []byte
+		maxDataSize int
+		want        error
+	}{
+		{"empty", nil, 16, io.EOF},
+		{"truncated fixed header", valid[:5], 16, io.ErrUnexpectedEOF},
+		{"truncated name", valid[:10], 16, io.ErrUnexpectedEOF},
+		{"truncated data length", valid[:8+len("shard")+2], 16, io.ErrUnexpectedEOF},
+		{"truncated data", valid[:len(valid)-1], 16, io.ErrUnexpectedEOF},
+		{"missing data", valid[:len(valid)-len("data")], 16, io.EOF},
+		{"unknown version", unknownVersion, 16, ErrUnknownVersion},
+		{"data over max size", valid, len("data") - 1, ErrTooLarge},
+		{"oversize data length", oversize, 1 << 20, ErrTooLarge},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := Read(bytes.NewReader(test.data), test.maxDataSize); err != test.want {
+				t.Errorf("Read() error = %v, want %v", err, test.want)
+			}
+		})
+	}
+}